@@ -1,10 +1,15 @@
 package cmd
 
 import (
+	"fmt"
+	"strings"
+
 	"code.cloudfoundry.org/eirini-persi/version"
 	eirinix "code.cloudfoundry.org/eirinix"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 
 	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
 
@@ -23,6 +28,25 @@ var startCmd = &cobra.Command{
 		viper.BindPFlag("operator-service-name", cmd.Flags().Lookup("operator-service-name"))
 		viper.BindPFlag("operator-webhook-namespace", cmd.Flags().Lookup("operator-webhook-namespace"))
 		viper.BindPFlag("register", cmd.Flags().Lookup("register"))
+		viper.BindPFlag("service-labels", cmd.Flags().Lookup("service-labels"))
+		viper.BindPFlag("all-volume-services", cmd.Flags().Lookup("all-volume-services"))
+		viper.BindPFlag("claim-validation", cmd.Flags().Lookup("claim-validation"))
+		viper.BindPFlag("mount-conflict-policy", cmd.Flags().Lookup("mount-conflict-policy"))
+		viper.BindPFlag("ownership-strategy", cmd.Flags().Lookup("ownership-strategy"))
+		viper.BindPFlag("owner-uid", cmd.Flags().Lookup("owner-uid"))
+		viper.BindPFlag("owner-gid", cmd.Flags().Lookup("owner-gid"))
+		viper.BindPFlag("security-context-mode", cmd.Flags().Lookup("security-context-mode"))
+		viper.BindPFlag("fs-group-change-policy", cmd.Flags().Lookup("fs-group-change-policy"))
+		viper.BindPFlag("init-image", cmd.Flags().Lookup("init-image"))
+		viper.BindPFlag("init-cpu", cmd.Flags().Lookup("init-cpu"))
+		viper.BindPFlag("init-memory", cmd.Flags().Lookup("init-memory"))
+		viper.BindPFlag("init-run-as-user", cmd.Flags().Lookup("init-run-as-user"))
+		viper.BindPFlag("dev-hostpath-volumes", cmd.Flags().Lookup("dev-hostpath-volumes"))
+		viper.BindPFlag("hostpath-root", cmd.Flags().Lookup("hostpath-root"))
+		viper.BindPFlag("mount-target-policy", cmd.Flags().Lookup("mount-target-policy"))
+		viper.BindPFlag("mount-targets", cmd.Flags().Lookup("mount-targets"))
+		viper.BindPFlag("mount-target-mode", cmd.Flags().Lookup("mount-target-mode"))
+		viper.BindPFlag("statefulset-mode", cmd.Flags().Lookup("statefulset-mode"))
 
 		viper.BindEnv("kubeconfig")
 		viper.BindEnv("namespace", "NAMESPACE")
@@ -31,6 +55,25 @@ var startCmd = &cobra.Command{
 		viper.BindEnv("operator-service-name", "OPERATOR_SERVICE_NAME")
 		viper.BindEnv("operator-webhook-namespace", "OPERATOR_WEBHOOK_NAMESPACE")
 		viper.BindEnv("register", "EIRINI_EXTENSION_REGISTER")
+		viper.BindEnv("service-labels", "SERVICE_LABELS")
+		viper.BindEnv("all-volume-services", "ALL_VOLUME_SERVICES")
+		viper.BindEnv("claim-validation", "CLAIM_VALIDATION")
+		viper.BindEnv("mount-conflict-policy", "MOUNT_CONFLICT_POLICY")
+		viper.BindEnv("ownership-strategy", "OWNERSHIP_STRATEGY")
+		viper.BindEnv("owner-uid", "OWNER_UID")
+		viper.BindEnv("owner-gid", "OWNER_GID")
+		viper.BindEnv("security-context-mode", "SECURITY_CONTEXT_MODE")
+		viper.BindEnv("fs-group-change-policy", "FS_GROUP_CHANGE_POLICY")
+		viper.BindEnv("init-image", "INIT_IMAGE")
+		viper.BindEnv("init-cpu", "INIT_CPU")
+		viper.BindEnv("init-memory", "INIT_MEMORY")
+		viper.BindEnv("init-run-as-user", "INIT_RUN_AS_USER")
+		viper.BindEnv("dev-hostpath-volumes", "DEV_HOSTPATH_VOLUMES")
+		viper.BindEnv("hostpath-root", "HOSTPATH_ROOT")
+		viper.BindEnv("mount-target-policy", "MOUNT_TARGET_POLICY")
+		viper.BindEnv("mount-targets", "MOUNT_TARGETS")
+		viper.BindEnv("mount-target-mode", "MOUNT_TARGET_MODE")
+		viper.BindEnv("statefulset-mode", "STATEFULSET_MODE")
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		defer log.Sync()
@@ -68,14 +111,116 @@ var startCmd = &cobra.Command{
 				RegisterWebHook:     &RegisterWebhooks,
 			})
 
-		x.AddExtension(persistence.New())
+		ownerUID := viper.GetInt64("owner-uid")
+		ownerGID := viper.GetInt64("owner-gid")
+		initRunAsUser := viper.GetInt64("init-run-as-user")
+		initResources, err := resourceRequirements(viper.GetString("init-cpu"), viper.GetString("init-memory"))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		opts := persistence.Options{
+			ServiceLabels:       splitList(viper.GetStringSlice("service-labels")),
+			AllVolumeServices:   viper.GetBool("all-volume-services"),
+			ClaimValidation:     viper.GetString("claim-validation"),
+			MountConflictPolicy: viper.GetString("mount-conflict-policy"),
+			OwnershipStrategy:   viper.GetString("ownership-strategy"),
+			OwnerUID:            &ownerUID,
+			OwnerGID:            &ownerGID,
+			SecurityContextMode: viper.GetString("security-context-mode"),
+			FSGroupChangePolicy: viper.GetString("fs-group-change-policy"),
+			InitImage:           viper.GetString("init-image"),
+			InitResources:       initResources,
+			InitSecurityContext: &corev1.SecurityContext{RunAsUser: &initRunAsUser},
+			HostPathVolumes:     viper.GetBool("dev-hostpath-volumes"),
+			HostPathRoot:        viper.GetString("hostpath-root"),
+			MountTargetPolicy:   viper.GetString("mount-target-policy"),
+			MountTargets:        splitList(viper.GetStringSlice("mount-targets")),
+			MountTargetMode:     viper.GetString("mount-target-mode"),
+			StatefulSetMode:     viper.GetBool("statefulset-mode"),
+		}
+		if err := opts.Validate(); err != nil {
+			log.Fatal(err.Error())
+		}
+		if opts.AllVolumeServices {
+			log.Info("Mounting volumes of all the services declaring volume mounts")
+		} else {
+			log.Infof("Mounting volumes of services with labels %s", strings.Join(opts.ServiceLabels, ", "))
+		}
+		if opts.HostPathVolumes {
+			log.Warnf("Mounting services of the %s plan as directories of the nodes under %s, for development clusters only", persistence.HostPathPlan, opts.HostPathRoot)
+		}
+		if opts.SecurityContextMode == persistence.SecurityContextLegacy {
+			log.Warnf("Apps with volumes run as their owner with the %s security context mode, %s is recommended", persistence.SecurityContextLegacy, persistence.SecurityContextMinimal)
+		}
+		log.Infof("Resolving the owner of the volumes with strategy %s (default uid %d, gid %d)", opts.OwnershipStrategy, ownerUID, ownerGID)
+
+		if opts.StatefulSetMode {
+			log.Info("Mounting volumes in the pod template of the StatefulSets of the apps")
+			x.AddExtension(persistence.NewStatefulSetMutator(opts))
+		} else {
+			x.AddExtension(persistence.NewWithOptions(opts))
+		}
+		if opts.SelectsSMBServices() {
+			x.AddExtension(persistence.NewSMBSecretCollectorWithOptions(opts))
+		}
 
 		log.Fatal(x.Start())
 	},
 }
 
+// splitList splits comma separated values, as lists coming from environment variables are not split by viper
+func splitList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// resourceRequirements returns requests and limits of the given cpu and memory. Empty values are left unset
+func resourceRequirements(cpu, memory string) (corev1.ResourceRequirements, error) {
+	resources := corev1.ResourceList{}
+	for name, value := range map[corev1.ResourceName]string{corev1.ResourceCPU: cpu, corev1.ResourceMemory: memory} {
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return corev1.ResourceRequirements{}, fmt.Errorf("invalid %s quantity %q: %w", name, value, err)
+		}
+		resources[name] = quantity
+	}
+	if len(resources) == 0 {
+		return corev1.ResourceRequirements{}, nil
+	}
+	return corev1.ResourceRequirements{Requests: resources, Limits: resources.DeepCopy()}, nil
+}
+
 func init() {
 	startCmd.Flags().BoolP("register", "r", true, "Register the extension")
+	startCmd.Flags().StringSlice("service-labels", []string{persistence.DefaultServiceLabel}, "Labels of the services in VCAP_SERVICES whose volumes are mounted")
+	startCmd.Flags().Bool("all-volume-services", false, "Mount the volumes of every service in VCAP_SERVICES declaring volume_mounts, regardless of its label")
+	startCmd.Flags().String("claim-validation", persistence.ClaimValidationDeny, "Policy for apps whose claims are missing, lost or don't match their volume mounts: deny, or warn to admit them with an annotation. Empty disables the validation")
+	startCmd.Flags().String("mount-conflict-policy", persistence.MountConflictReject, "Policy for volume mounts conflicting with each other or with the existing ones: reject, skip, or last-wins. Empty disables the detection")
+	startCmd.Flags().String("ownership-strategy", persistence.OwnershipGuess, "Strategy resolving the user and group owning the volumes: guess, fixed, namespace-annotation, pod-annotation, binding or container")
+	startCmd.Flags().Int64("owner-uid", persistence.DefaultVcapID, "User owning the volumes with the fixed strategy, and when other strategies can't resolve it")
+	startCmd.Flags().Int64("owner-gid", persistence.DefaultVcapID, "Group owning the volumes with the fixed strategy, and when other strategies can't resolve it")
+	startCmd.Flags().String("security-context-mode", persistence.SecurityContextMinimal, "How the owner of the volumes is set: minimal (fsGroup only), supplemental (supplemental groups only), legacy (also run as user and group) or init-container (chown of the mount points in an init container)")
+	startCmd.Flags().String("fs-group-change-policy", "", "fsGroupChangePolicy of the pods with volumes, e.g. OnRootMismatch. Ignored on clusters older than 1.20")
+	startCmd.Flags().String("init-image", persistence.DefaultInitImage, "Image of the init container changing the ownership of the volumes in init-container mode")
+	startCmd.Flags().String("init-cpu", "10m", "CPU request and limit of the init container changing the ownership of the volumes")
+	startCmd.Flags().String("init-memory", "16Mi", "Memory request and limit of the init container changing the ownership of the volumes")
+	startCmd.Flags().Int64("init-run-as-user", 0, "User the init container changing the ownership of the volumes runs as")
+	startCmd.Flags().Bool("dev-hostpath-volumes", false, "Mount the services of the hostpath plan as directories of the nodes instead of claims. For single node development clusters only")
+	startCmd.Flags().String("hostpath-root", persistence.DefaultHostPathRoot, "Node directory containing a subdirectory per volume id of the hostpath plan services")
+	startCmd.Flags().String("mount-target-policy", "", "Containers and init containers without VCAP_SERVICES the volumes are also mounted in: all, pattern (matching --mount-targets) or annotation (matching the eirini-persi.cloudfoundry.org/mount-targets pod annotation). Empty only mounts app containers")
+	startCmd.Flags().StringSlice("mount-targets", []string{}, "Comma separated name[=mode] rules of the containers the volumes are mounted in with the pattern policy, where name is a regular expression and mode r (default) or rw")
+	startCmd.Flags().String("mount-target-mode", persistence.ModeReadOnly, "Mode of the volumes mounted in the containers with the all policy: r or rw")
+	startCmd.Flags().Bool("statefulset-mode", false, "Mount the volumes in the pod template of the StatefulSets of the apps instead of in their pods")
 
 	rootCmd.AddCommand(startCmd)
 }
@@ -0,0 +1,143 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// ClaimValidationDeny denies the admission of pods whose claims are not suitable for their volume mounts
+	ClaimValidationDeny = "deny"
+	// ClaimValidationWarn admits pods whose claims are not suitable for their volume mounts, and annotates them with the problems found
+	ClaimValidationWarn = "warn"
+
+	// DeviceTypeShared is the device type of volumes mounted by several app instances at the same time
+	DeviceTypeShared = "shared"
+	// DeviceTypeExclusive is the device type of volumes mounted by a single app instance
+	DeviceTypeExclusive = "exclusive"
+
+	// WarningsAnnotation is the pod annotation listing the volume problems of pods admitted with ClaimValidationWarn
+	WarningsAnnotation = "eirini-persi.cloudfoundry.org/warnings"
+)
+
+func hasAccessMode(modes []corev1.PersistentVolumeAccessMode, wanted ...corev1.PersistentVolumeAccessMode) bool {
+	for _, m := range modes {
+		for _, w := range wanted {
+			if m == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkDeviceType returns a description of the problem if the claim access modes don't allow mounting it with the device type given as argument
+func checkDeviceType(claim *corev1.PersistentVolumeClaim, deviceType string) string {
+	modes := claim.Spec.AccessModes
+	if len(claim.Status.AccessModes) > 0 {
+		modes = claim.Status.AccessModes
+	}
+
+	switch deviceType {
+	case "":
+		return ""
+	case DeviceTypeShared:
+		if !hasAccessMode(modes, corev1.ReadWriteMany, corev1.ReadOnlyMany) {
+			return fmt.Sprintf("claim %s has access modes %v, but device_type %s requires ReadWriteMany or ReadOnlyMany", claim.Name, modes, deviceType)
+		}
+	case DeviceTypeExclusive:
+		if !hasAccessMode(modes, corev1.ReadWriteOnce, corev1.ReadWriteMany) {
+			return fmt.Sprintf("claim %s has access modes %v, but device_type %s requires ReadWriteOnce or ReadWriteMany", claim.Name, modes, deviceType)
+		}
+	default:
+		return fmt.Sprintf("invalid device_type %q for claim %s: must be %q or %q", deviceType, claim.Name, DeviceTypeShared, DeviceTypeExclusive)
+	}
+	return ""
+}
+
+// checkClaim returns a description of the problem if the claim can't be mounted at all
+func checkClaim(claim *corev1.PersistentVolumeClaim) string {
+	if claim.DeletionTimestamp != nil {
+		return fmt.Sprintf("claim %s is being deleted", claim.Name)
+	}
+	if claim.Status.Phase == corev1.ClaimLost {
+		return fmt.Sprintf("claim %s is lost, its volume does not exist anymore", claim.Name)
+	}
+	return ""
+}
+
+// getClaim returns the claim with the given name, or nil if it doesn't exist
+func (ext *Extension) getClaim(ctx context.Context, namespace, name string) (*corev1.PersistentVolumeClaim, error) {
+	claim := &corev1.PersistentVolumeClaim{}
+	err := ext.reader().Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, claim)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("looking up claim %s: %w", name, err)
+	}
+	return claim, nil
+}
+
+// ValidateClaims looks up the claims of the services mounted by the pod in the namespace given as argument.
+// It returns the problems found, i.e. claims which are missing, being deleted, lost or can't be looked up, and
+// claims that can't be mounted with the device type requested by the app.
+func (ext *Extension) ValidateClaims(ctx context.Context, namespace string, pod *corev1.Pod) ([]string, error) {
+	services, err := ext.resolveServices(ctx, namespace, pod)
+	if err != nil {
+		return nil, err
+	}
+	return ext.validateClaims(ctx, namespace, services.all(pod), map[string]*corev1.PersistentVolumeClaim{})
+}
+
+// validateClaims validates the claims of the services. Claims already known, e.g. because they are about to be
+// provisioned, are not looked up again.
+func (ext *Extension) validateClaims(ctx context.Context, namespace string, services []VcapService, claims map[string]*corev1.PersistentVolumeClaim) ([]string, error) {
+	var problems []string
+	seen := map[string]bool{}
+	addProblem := func(problem string) {
+		if problem != "" && !seen[problem] {
+			seen[problem] = true
+			problems = append(problems, problem)
+		}
+	}
+
+	for _, service := range services {
+		if !service.isClaim() {
+			continue
+		}
+		claimName := service.Credentials.VolumeID
+
+		claim, checked := claims[claimName]
+		if !checked {
+			if ext.reader() == nil {
+				return nil, errors.New("no kubernetes client available to validate the claims")
+			}
+			var err error
+			claim, err = ext.getClaim(ctx, namespace, claimName)
+			if err != nil {
+				// Claims which can't be looked up are handled by the validation policy, as missing ones
+				addProblem(err.Error())
+				continue
+			}
+			claims[claimName] = claim
+		}
+		if claim == nil {
+			addProblem(fmt.Sprintf("claim %s not found in namespace %s", claimName, namespace))
+			continue
+		}
+		if problem := checkClaim(claim); problem != "" {
+			addProblem(problem)
+			continue
+		}
+
+		for _, volumeMount := range service.VolumeMounts {
+			addProblem(checkDeviceType(claim, volumeMount.DeviceType))
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,323 @@
+package persistence_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinix "code.cloudfoundry.org/eirinix"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cfakes "code.cloudfoundry.org/eirini-persi/pkg/controllers/fakes"
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Claims validation", func() {
+	var (
+		eiriniManager eirinix.Manager
+		client        *cfakes.FakeClient
+		ctx           context.Context
+		env           testing.Catalog
+		request       admission.Request
+		claims        map[string]corev1.PersistentVolumeClaim
+	)
+
+	newExtension := func(policy string) *persistence.Extension {
+		ext, ok := persistence.NewWithOptions(persistence.Options{ClaimValidation: policy}).(*persistence.Extension)
+		Expect(ok).To(BeTrue())
+		ext.Client = client
+		return ext
+	}
+
+	BeforeEach(func() {
+		claims = map[string]corev1.PersistentVolumeClaim{}
+		client = &cfakes.FakeClient{}
+		client.GetCalls(func(_ context.Context, nn types.NamespacedName, obj runtime.Object) error {
+			claim, ok := claims[nn.Name]
+			if !ok || nn.Namespace != "eirini" {
+				return apierrors.NewNotFound(schema.GroupResource{Resource: "persistentvolumeclaims"}, nn.Name)
+			}
+			claim.DeepCopyInto(obj.(*corev1.PersistentVolumeClaim))
+			return nil
+		})
+
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		eiriniManager = eirinixcat.SimpleManager()
+		request = admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Namespace: "eirini"}}
+	})
+
+	Describe("ValidateClaims", func() {
+		It("accepts shared mounts of ReadWriteMany claims", func() {
+			claims["the-volume-id"] = env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteMany)
+			pod := env.SimplePersiApp("foo")
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(BeEmpty())
+			Expect(client.GetCallCount()).To(Equal(1))
+		})
+
+		It("accepts shared mounts of ReadOnlyMany claims", func() {
+			claims["the-volume-id"] = env.PersistentVolumeClaim("the-volume-id", corev1.ReadOnlyMany)
+			pod := env.SimplePersiApp("foo")
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(BeEmpty())
+		})
+
+		It("reports shared mounts of ReadWriteOnce claims", func() {
+			claims["the-volume-id"] = env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteOnce)
+			pod := env.SimplePersiApp("foo")
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(HaveLen(1))
+			Expect(problems[0]).To(ContainSubstring("device_type shared requires ReadWriteMany or ReadOnlyMany"))
+		})
+
+		It("accepts exclusive mounts of ReadWriteOnce claims", func() {
+			claims["the-volume-id"] = env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteOnce)
+			pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "the-volume-id"}, "volume_mounts": [{"container_dir": "/data", "device_type": "exclusive"}]}]}`)
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(BeEmpty())
+		})
+
+		It("accepts exclusive mounts of ReadWriteMany claims", func() {
+			claims["the-volume-id"] = env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteMany)
+			pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "the-volume-id"}, "volume_mounts": [{"container_dir": "/data", "device_type": "exclusive"}]}]}`)
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(BeEmpty())
+		})
+
+		It("reports exclusive mounts of ReadOnlyMany claims", func() {
+			claims["the-volume-id"] = env.PersistentVolumeClaim("the-volume-id", corev1.ReadOnlyMany)
+			pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "the-volume-id"}, "volume_mounts": [{"container_dir": "/data", "device_type": "exclusive"}]}]}`)
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(HaveLen(1))
+			Expect(problems[0]).To(ContainSubstring("device_type exclusive requires ReadWriteOnce or ReadWriteMany"))
+		})
+
+		It("uses the access modes of the bound volume", func() {
+			claim := env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteMany)
+			claim.Status.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+			claims["the-volume-id"] = claim
+			pod := env.SimplePersiApp("foo")
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(HaveLen(1))
+		})
+
+		It("reports unknown device types", func() {
+			claims["the-volume-id"] = env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteOnce)
+			pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "the-volume-id"}, "volume_mounts": [{"container_dir": "/data", "device_type": "block"}]}]}`)
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(HaveLen(1))
+			Expect(problems[0]).To(ContainSubstring(`invalid device_type "block"`))
+		})
+
+		It("reports missing claims", func() {
+			pod := env.SimplePersiApp("foo")
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(ConsistOf("claim the-volume-id not found in namespace eirini"))
+		})
+
+		It("looks up claims in the namespace given as argument", func() {
+			claims["the-volume-id"] = env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteMany)
+			pod := env.SimplePersiApp("foo")
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "other", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(ConsistOf("claim the-volume-id not found in namespace other"))
+			_, nn, _ := client.GetArgsForCall(0)
+			Expect(nn.Namespace).To(Equal("other"))
+		})
+
+		It("reports claims being deleted", func() {
+			claim := env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteMany)
+			now := metav1.Now()
+			claim.DeletionTimestamp = &now
+			claims["the-volume-id"] = claim
+			pod := env.SimplePersiApp("foo")
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(ConsistOf("claim the-volume-id is being deleted"))
+		})
+
+		It("reports lost claims", func() {
+			claim := env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteMany)
+			claim.Status.Phase = corev1.ClaimLost
+			claims["the-volume-id"] = claim
+			pod := env.SimplePersiApp("foo")
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(ConsistOf("claim the-volume-id is lost, its volume does not exist anymore"))
+		})
+
+		It("looks up each claim once", func() {
+			pod := env.MultipleMountsPersiApp("foo")
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(HaveLen(1))
+			Expect(client.GetCallCount()).To(Equal(1))
+		})
+
+		It("reports the claims which can't be looked up", func() {
+			client.GetReturns(errors.New("boom"))
+			client.GetCalls(nil)
+			pod := env.SimplePersiApp("foo")
+
+			problems, err := newExtension(persistence.ClaimValidationDeny).ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(ConsistOf("looking up claim the-volume-id: boom"))
+		})
+
+		It("doesn't need a client for pods without claims", func() {
+			ext := newExtension(persistence.ClaimValidationDeny)
+			ext.Client = nil
+			pod := env.DefaultEiriniAppPod("foo", `{}`)
+
+			problems, err := ext.ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(problems).To(BeEmpty())
+		})
+
+		It("returns an error if there is no client to look up the claims", func() {
+			ext := newExtension(persistence.ClaimValidationDeny)
+			ext.Client = nil
+			pod := env.SimplePersiApp("foo")
+
+			_, err := ext.ValidateClaims(ctx, "eirini", &pod)
+			Expect(err).To(MatchError("no kubernetes client available to validate the claims"))
+		})
+	})
+
+	Describe("Handle", func() {
+		It("denies pods with mismatching claims", func() {
+			claims["the-volume-id"] = env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteOnce)
+			pod := env.SimplePersiApp("foo")
+			raw, _ := json.Marshal(&pod)
+			request.Object.Raw = raw
+
+			resp := newExtension(persistence.ClaimValidationDeny).Handle(ctx, eiriniManager, &pod, request)
+			Expect(resp.AdmissionResponse.Allowed).To(BeFalse())
+			Expect(resp.AdmissionResponse.Result.Code).To(Equal(int32(http.StatusForbidden)))
+			Expect(string(resp.AdmissionResponse.Result.Reason)).To(ContainSubstring("claim the-volume-id has access modes"))
+		})
+
+		It("annotates pods with mismatching claims when warning", func() {
+			claims["the-volume-id"] = env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteOnce)
+			pod := env.SimplePersiApp("foo")
+			raw, _ := json.Marshal(&pod)
+			request.Object.Raw = raw
+
+			resp := newExtension(persistence.ClaimValidationWarn).Handle(ctx, eiriniManager, &pod, request)
+			Expect(resp.AdmissionResponse.Allowed).To(BeTrue())
+			Expect(decodePatches(resp)).To(ContainSubstring(`"eirini-persi.cloudfoundry.org/warnings":"claim the-volume-id has access modes`))
+		})
+
+		It("denies pods with missing claims", func() {
+			pod := env.SimplePersiApp("foo")
+			raw, _ := json.Marshal(&pod)
+			request.Object.Raw = raw
+
+			resp := newExtension(persistence.ClaimValidationDeny).Handle(ctx, eiriniManager, &pod, request)
+			Expect(resp.AdmissionResponse.Allowed).To(BeFalse())
+			Expect(string(resp.AdmissionResponse.Result.Reason)).To(Equal("claim the-volume-id not found in namespace eirini"))
+		})
+
+		It("admits pods with missing claims when warning", func() {
+			pod := env.SimplePersiApp("foo")
+			raw, _ := json.Marshal(&pod)
+			request.Object.Raw = raw
+
+			resp := newExtension(persistence.ClaimValidationWarn).Handle(ctx, eiriniManager, &pod, request)
+			Expect(resp.AdmissionResponse.Allowed).To(BeTrue())
+			Expect(decodePatches(resp)).To(ContainSubstring(`"eirini-persi.cloudfoundry.org/warnings":"claim the-volume-id not found in namespace eirini"`))
+		})
+
+		It("denies pods whose claims can't be looked up", func() {
+			client.GetReturns(errors.New("boom"))
+			client.GetCalls(nil)
+			pod := env.SimplePersiApp("foo")
+			raw, _ := json.Marshal(&pod)
+			request.Object.Raw = raw
+
+			resp := newExtension(persistence.ClaimValidationDeny).Handle(ctx, eiriniManager, &pod, request)
+			Expect(resp.AdmissionResponse.Allowed).To(BeFalse())
+			Expect(resp.AdmissionResponse.Result.Code).To(Equal(int32(http.StatusForbidden)))
+			Expect(string(resp.AdmissionResponse.Result.Reason)).To(Equal("looking up claim the-volume-id: boom"))
+		})
+
+		It("admits pods whose claims can't be looked up when warning", func() {
+			client.GetReturns(errors.New("boom"))
+			client.GetCalls(nil)
+			pod := env.SimplePersiApp("foo")
+			raw, _ := json.Marshal(&pod)
+			request.Object.Raw = raw
+
+			resp := newExtension(persistence.ClaimValidationWarn).Handle(ctx, eiriniManager, &pod, request)
+			Expect(resp.AdmissionResponse.Allowed).To(BeTrue())
+			Expect(decodePatches(resp)).To(ContainSubstring(`"eirini-persi.cloudfoundry.org/warnings":"looking up claim the-volume-id: boom"`))
+		})
+
+		It("admits pods without volumes when there is no client", func() {
+			ext := newExtension(persistence.ClaimValidationDeny)
+			ext.Client = nil
+			pod := env.DefaultEiriniAppPod("foo", `{}`)
+			raw, _ := json.Marshal(&pod)
+			request.Object.Raw = raw
+
+			resp := ext.Handle(ctx, eiriniManager, &pod, request)
+			Expect(resp.AdmissionResponse.Allowed).To(BeTrue())
+		})
+
+		It("does not validate claims if disabled", func() {
+			pod := env.SimplePersiApp("foo")
+			raw, _ := json.Marshal(&pod)
+			request.Object.Raw = raw
+
+			resp := newExtension("").Handle(ctx, eiriniManager, &pod, request)
+			Expect(resp.AdmissionResponse.Allowed).To(BeTrue())
+			Expect(client.GetCallCount()).To(Equal(0))
+		})
+
+		It("admits pods with matching claims", func() {
+			claims["the-volume-id"] = env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteMany)
+			pod := env.SimplePersiApp("foo")
+			raw, _ := json.Marshal(&pod)
+			request.Object.Raw = raw
+
+			resp := newExtension(persistence.ClaimValidationDeny).Handle(ctx, eiriniManager, &pod, request)
+			Expect(resp.AdmissionResponse.Allowed).To(BeTrue())
+			Expect(len(resp.Patches)).To(Equal(4))
+		})
+	})
+})
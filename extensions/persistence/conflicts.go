@@ -0,0 +1,133 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+const (
+	// MountConflictReject rejects pods whose volume mounts conflict with each other or with the existing ones
+	MountConflictReject = "reject"
+	// MountConflictSkip skips the conflicting volume mounts, and annotates the pod with a warning
+	MountConflictSkip = "skip"
+	// MountConflictLastWins replaces the existing volumes and mounts by the conflicting ones
+	MountConflictLastWins = "last-wins"
+)
+
+// addWarning appends a warning to the warnings annotation of the pod
+func addWarning(pod *corev1.Pod, warning string) {
+	var warnings []string
+	if annotation := pod.Annotations[WarningsAnnotation]; annotation != "" {
+		warnings = strings.Split(annotation, "; ")
+	}
+	for _, w := range warnings {
+		if w == warning {
+			return
+		}
+	}
+	setAnnotation(pod, WarningsAnnotation, strings.Join(append(warnings, warning), "; "))
+}
+
+// nestedPaths returns true if the paths are the same, or one of them is inside the other
+func nestedPaths(a, b string) bool {
+	a, b = path.Clean(a), path.Clean(b)
+	if a == b || a == "/" || b == "/" {
+		return true
+	}
+	return strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+func findVolume(volumes []corev1.Volume, name string) *corev1.Volume {
+	for i := range volumes {
+		if volumes[i].Name == name {
+			return &volumes[i]
+		}
+	}
+	return nil
+}
+
+// volumeReferenced returns true if a container or init container of the pod mounts the volume
+func volumeReferenced(pod *corev1.Pod, name string) bool {
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			for _, m := range c.VolumeMounts {
+				if m.Name == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// removeVolume removes the volume with the given name from the pod
+func removeVolume(pod *corev1.Pod, name string) {
+	volumes := pod.Spec.Volumes[:0]
+	for _, v := range pod.Spec.Volumes {
+		if v.Name != name {
+			volumes = append(volumes, v)
+		}
+	}
+	pod.Spec.Volumes = volumes
+}
+
+// resolveConflicts checks that the volume and the mount given as arguments can be added to the pod and
+// to the container, according to the conflict policy. It returns true if the mount has to be skipped.
+// Conflicts are mounts on the same or on nested paths, and other volumes with the same name.
+func resolveConflicts(pod *corev1.Pod, c *corev1.Container, volume corev1.Volume, mount corev1.VolumeMount, policy string) (bool, error) {
+	if policy == "" {
+		return false, nil
+	}
+
+	var conflicts []string
+	existing := findVolume(pod.Spec.Volumes, volume.Name)
+	volumeClash := existing != nil && !equality.Semantic.DeepEqual(existing.VolumeSource, volume.VolumeSource)
+	if volumeClash {
+		conflicts = append(conflicts, fmt.Sprintf("volume %s already exists in the pod", volume.Name))
+	}
+
+	var conflictingMounts []corev1.VolumeMount
+	for _, m := range c.VolumeMounts {
+		if nestedPaths(m.MountPath, mount.MountPath) {
+			conflictingMounts = append(conflictingMounts, m)
+			conflicts = append(conflicts, fmt.Sprintf("mount path %s of volume %s conflicts with mount path %s of volume %s in container %s", mount.MountPath, mount.Name, m.MountPath, m.Name, c.Name))
+		}
+	}
+
+	if len(conflicts) == 0 {
+		return false, nil
+	}
+
+	switch policy {
+	case MountConflictSkip:
+		for _, conflict := range conflicts {
+			addWarning(pod, "skipped: "+conflict)
+		}
+		return true, nil
+	case MountConflictLastWins:
+		mounts := c.VolumeMounts[:0]
+		for _, m := range c.VolumeMounts {
+			if !nestedPaths(m.MountPath, mount.MountPath) {
+				mounts = append(mounts, m)
+			}
+		}
+		c.VolumeMounts = mounts
+
+		// The volume being replaced is dropped as well as the volumes that are not mounted anymore
+		if volumeClash {
+			removeVolume(pod, volume.Name)
+		}
+		for _, m := range conflictingMounts {
+			if !volumeReferenced(pod, m.Name) {
+				removeVolume(pod, m.Name)
+			}
+		}
+		return false, nil
+	}
+	return false, errors.New(strings.Join(conflicts, "; "))
+}
@@ -0,0 +1,128 @@
+package persistence_test
+
+import (
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Mount conflicts", func() {
+	var (
+		env  testing.Catalog
+		pod  corev1.Pod
+		opts persistence.Options
+	)
+
+	service := func(volumeID string, dirs ...string) persistence.VcapService {
+		s := persistence.VcapService{Credentials: persistence.Credentials{VolumeID: volumeID}}
+		for _, dir := range dirs {
+			s.VolumeMounts = append(s.VolumeMounts, persistence.VolumeMount{ContainerDir: dir})
+		}
+		return s
+	}
+
+	BeforeEach(func() {
+		pod = env.DefaultEiriniAppPod("bar", ``)
+		pod.Spec.Volumes = []corev1.Volume{{Name: "secrets", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+		pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "secrets", MountPath: "/var/run/secrets"}}
+		opts = persistence.Options{}
+	})
+
+	Context("without policy", func() {
+		It("does not detect conflicts", func() {
+			services := persistence.VcapServices{ServiceMap: []persistence.VcapService{service("foo", "/data"), service("bar", "/data")}}
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], opts)).To(Succeed())
+			Expect(pod.Spec.Containers[0].VolumeMounts).To(HaveLen(3))
+		})
+	})
+
+	Context("when rejecting conflicts", func() {
+		BeforeEach(func() {
+			opts.MountConflictPolicy = persistence.MountConflictReject
+		})
+
+		It("rejects services mounted on the same path", func() {
+			services := persistence.VcapServices{ServiceMap: []persistence.VcapService{service("foo", "/data"), service("bar", "/data/")}}
+
+			err := services.AppendMounts(&pod, &pod.Spec.Containers[0], opts)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("mount path /data/ of volume bar conflicts with mount path /data of volume foo"))
+		})
+
+		It("rejects nested mount paths", func() {
+			services := persistence.VcapServices{ServiceMap: []persistence.VcapService{service("foo", "/var/run")}}
+
+			err := services.AppendMounts(&pod, &pod.Spec.Containers[0], opts)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("conflicts with mount path /var/run/secrets of volume secrets"))
+		})
+
+		It("rejects volume names which are already used by the pod", func() {
+			services := persistence.VcapServices{ServiceMap: []persistence.VcapService{service("secrets", "/data")}}
+
+			err := services.AppendMounts(&pod, &pod.Spec.Containers[0], opts)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("volume secrets already exists in the pod"))
+		})
+
+		It("accepts sibling paths", func() {
+			services := persistence.VcapServices{ServiceMap: []persistence.VcapService{service("foo", "/data", "/database"), service("bar", "/var/run/other")}}
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], opts)).To(Succeed())
+			Expect(pod.Spec.Containers[0].VolumeMounts).To(HaveLen(4))
+		})
+
+		It("accepts the volumes and mounts it already added", func() {
+			services := persistence.VcapServices{ServiceMap: []persistence.VcapService{service("foo", "/data")}}
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], opts)).To(Succeed())
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], opts)).To(Succeed())
+			Expect(pod.Spec.Containers[0].VolumeMounts).To(HaveLen(2))
+			Expect(pod.Spec.Volumes).To(HaveLen(2))
+		})
+	})
+
+	Context("when skipping conflicts", func() {
+		BeforeEach(func() {
+			opts.MountConflictPolicy = persistence.MountConflictSkip
+		})
+
+		It("skips the conflicting mounts with a warning", func() {
+			services := persistence.VcapServices{ServiceMap: []persistence.VcapService{service("foo", "/data"), service("bar", "/data")}}
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], opts)).To(Succeed())
+			Expect(pod.Spec.Containers[0].VolumeMounts).To(HaveLen(2))
+			Expect(pod.Spec.Containers[0].VolumeMounts[1].Name).To(Equal("foo"))
+			Expect(pod.Spec.Volumes).To(HaveLen(2))
+			Expect(pod.Annotations["eirini-persi.cloudfoundry.org/warnings"]).To(Equal("skipped: mount path /data of volume bar conflicts with mount path /data of volume foo in container busybox"))
+		})
+	})
+
+	Context("when the last mount wins", func() {
+		BeforeEach(func() {
+			opts.MountConflictPolicy = persistence.MountConflictLastWins
+		})
+
+		It("replaces the conflicting mounts and drops unused volumes", func() {
+			services := persistence.VcapServices{ServiceMap: []persistence.VcapService{service("foo", "/var/run"), service("bar", "/var/run")}}
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], opts)).To(Succeed())
+			Expect(pod.Spec.Containers[0].VolumeMounts).To(HaveLen(1))
+			Expect(pod.Spec.Containers[0].VolumeMounts[0].Name).To(Equal("bar"))
+			Expect(pod.Spec.Volumes).To(HaveLen(1))
+			Expect(pod.Spec.Volumes[0].Name).To(Equal("bar"))
+		})
+
+		It("replaces volumes with the same name", func() {
+			services := persistence.VcapServices{ServiceMap: []persistence.VcapService{service("secrets", "/data")}}
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], opts)).To(Succeed())
+			Expect(pod.Spec.Volumes).To(HaveLen(1))
+			Expect(pod.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("secrets"))
+		})
+	})
+})
@@ -0,0 +1,45 @@
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// CSIConfig is the inline CSI volume declared by the credentials of a service
+type CSIConfig struct {
+	// Driver is the name of the CSI driver mounting the volume
+	Driver string `json:"driver"`
+	// FSType is the filesystem type of the volume, e.g. ext4. The driver decides if empty
+	FSType string `json:"fs_type"`
+	// VolumeAttributes are the driver specific properties of the volume
+	VolumeAttributes map[string]string `json:"volume_attributes"`
+}
+
+// csiVolumeID returns the id of the inline CSI volume of the service: its volume id if any, its driver and attributes otherwise
+func (s VcapService) csiVolumeID() string {
+	if s.Credentials.VolumeID != "" || s.Credentials.CSI == nil {
+		return s.Credentials.VolumeID
+	}
+	// Maps are marshalled with sorted keys
+	attributes, _ := json.Marshal(s.Credentials.CSI.VolumeAttributes)
+	return s.Credentials.CSI.Driver + string(attributes)
+}
+
+// csiVolumeSource returns the inline CSI volume source of the service
+func (s VcapService) csiVolumeSource(readOnly bool) (corev1.VolumeSource, error) {
+	config := s.Credentials.CSI
+	if config == nil || config.Driver == "" {
+		return corev1.VolumeSource{}, fmt.Errorf("missing csi driver for volume %s", s.csiVolumeID())
+	}
+	source := &corev1.CSIVolumeSource{
+		Driver:           config.Driver,
+		ReadOnly:         &readOnly,
+		VolumeAttributes: config.VolumeAttributes,
+	}
+	if config.FSType != "" {
+		source.FSType = &config.FSType
+	}
+	return corev1.VolumeSource{CSI: source}, nil
+}
@@ -0,0 +1,74 @@
+package persistence_test
+
+import (
+	"context"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	cfakes "code.cloudfoundry.org/eirini-persi/pkg/controllers/fakes"
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Inline CSI volumes", func() {
+	var (
+		env testing.Catalog
+		ctx context.Context
+		ext *persistence.Extension
+	)
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		ext = &persistence.Extension{Logger: eirinixcat.SimpleManager().GetLogger()}
+	})
+
+	It("mounts the CSI volume declared by the credentials instead of the claim", func() {
+		pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "the-volume-id", "csi": {"driver": "secrets-store.csi.k8s.io", "fs_type": "ext4", "volume_attributes": {"secretProviderClass": "vault"}}}, "volume_mounts": [{"container_dir": "/secrets", "mode": "r"}]}]}`)
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		Expect(pod.Spec.Volumes[0].Name).To(Equal("the-volume-id"))
+		Expect(pod.Spec.Volumes[0].PersistentVolumeClaim).To(BeNil())
+		csi := pod.Spec.Volumes[0].CSI
+		Expect(csi.Driver).To(Equal("secrets-store.csi.k8s.io"))
+		Expect(*csi.FSType).To(Equal("ext4"))
+		Expect(*csi.ReadOnly).To(BeTrue())
+		Expect(csi.VolumeAttributes).To(Equal(map[string]string{"secretProviderClass": "vault"}))
+		Expect(pod.Spec.Containers[0].VolumeMounts[0].Name).To(Equal("the-volume-id"))
+	})
+
+	It("names volumes without volume id after their driver and attributes", func() {
+		pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [
+			{"credentials": {"csi": {"driver": "example.csi.k8s.io", "volume_attributes": {"share": "a"}}}, "volume_mounts": [{"container_dir": "/a"}]},
+			{"credentials": {"csi": {"driver": "example.csi.k8s.io", "volume_attributes": {"share": "b"}}}, "volume_mounts": [{"container_dir": "/b"}]}
+		]}`)
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(HaveLen(2))
+		Expect(pod.Spec.Volumes[0].Name).ToNot(Equal(pod.Spec.Volumes[1].Name))
+		Expect(pod.Spec.Volumes[0].CSI.FSType).To(BeNil())
+	})
+
+	It("requires a driver", func() {
+		pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "the-volume-id", "csi": {}}, "volume_mounts": [{"container_dir": "/data"}]}]}`)
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(MatchError("missing csi driver for volume the-volume-id"))
+	})
+
+	It("does not look up claims", func() {
+		client := &cfakes.FakeClient{}
+		ext.Client = client
+		pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "the-volume-id", "size": "1Gi", "csi": {"driver": "example.csi.k8s.io"}}, "volume_mounts": [{"container_dir": "/data"}]}]}`)
+
+		_, err := ext.ProvisionClaims(ctx, "eirini", &pod)
+		Expect(err).ToNot(HaveOccurred())
+		problems, err := ext.ValidateClaims(ctx, "eirini", &pod)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(problems).To(BeEmpty())
+		Expect(client.GetCallCount()).To(Equal(0))
+		Expect(client.CreateCallCount()).To(Equal(0))
+	})
+})
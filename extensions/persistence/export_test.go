@@ -0,0 +1,7 @@
+package persistence
+
+// The webhook helpers of the StatefulSet mode are exported for the tests of the persistence_test package
+var (
+	AppendWebhooks     = appendWebhooks
+	StatefulSetWebhook = statefulSetWebhook
+)
@@ -0,0 +1,99 @@
+package persistence
+
+import (
+	"fmt"
+
+	eirinix "code.cloudfoundry.org/eirinix"
+	corev1 "k8s.io/api/core/v1"
+	utilversion "k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+)
+
+// fsGroupChangePolicyMinVersion is the first Kubernetes version where fsGroupChangePolicy is enabled by default
+var fsGroupChangePolicyMinVersion = utilversion.MustParseGeneric("1.20.0")
+
+// validateFSGroupChangePolicy returns an error if the fs group change policy is unknown
+func validateFSGroupChangePolicy(policy string) error {
+	switch corev1.PodFSGroupChangePolicy(policy) {
+	case "", corev1.FSGroupChangeOnRootMismatch, corev1.FSGroupChangeAlways:
+		return nil
+	}
+	return fmt.Errorf("invalid fs group change policy %q: must be %q or %q", policy, corev1.FSGroupChangeOnRootMismatch, corev1.FSGroupChangeAlways)
+}
+
+// fsGroupChangePolicy returns the fs group change policy of the first binding declaring one,
+// falling back to the one of the options
+func (ext *Extension) fsGroupChangePolicy(services []VcapService) (string, error) {
+	for _, service := range services {
+		for _, volumeMount := range service.VolumeMounts {
+			if policy := volumeMount.MountConfig.FSGroupChangePolicy; policy != "" {
+				return policy, validateFSGroupChangePolicy(policy)
+			}
+		}
+	}
+	return ext.Options.FSGroupChangePolicy, nil
+}
+
+// kubeVersionLookup returns a function looking up the version of the API server of the manager
+func kubeVersionLookup(eiriniManager eirinix.Manager) func() (*version.Info, error) {
+	return func() (*version.Info, error) {
+		config, err := eiriniManager.GetKubeConnection()
+		if err != nil {
+			return nil, err
+		}
+		client, err := discovery.NewDiscoveryClientForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return client.ServerVersion()
+	}
+}
+
+// fsGroupChangePolicySupported returns true if the API server supports the fsGroupChangePolicy field.
+// The version of the API server is looked up once, and considered unsupported if unknown, even if the lookup failed.
+func (ext *Extension) fsGroupChangePolicySupported() bool {
+	ext.kubeVersionOnce.Do(func() {
+		ext.kubeVersion = ext.KubeVersion
+		if ext.kubeVersion != nil || ext.KubeVersionLookup == nil {
+			return
+		}
+		info, err := ext.KubeVersionLookup()
+		if err != nil {
+			ext.Logger.Warnf("Could not look up the Kubernetes version, fs group change policies are ignored: %s", err.Error())
+			return
+		}
+		ext.kubeVersion = info
+	})
+	if ext.kubeVersion == nil {
+		return false
+	}
+
+	v, err := utilversion.ParseGeneric(ext.kubeVersion.GitVersion)
+	if err != nil {
+		ext.Logger.Warnf("Could not parse the Kubernetes version %s: %s", ext.kubeVersion.GitVersion, err.Error())
+		return false
+	}
+	return v.AtLeast(fsGroupChangePolicyMinVersion)
+}
+
+// setFSGroupChangePolicy sets the fs group change policy of the pod, if it has an fs group and the cluster supports it
+func (ext *Extension) setFSGroupChangePolicy(pod *corev1.Pod, services []VcapService) error {
+	policy, err := ext.fsGroupChangePolicy(services)
+	if err != nil || policy == "" {
+		return err
+	}
+
+	sc := pod.Spec.SecurityContext
+	if sc == nil || sc.FSGroup == nil || sc.FSGroupChangePolicy != nil {
+		return nil
+	}
+	if !ext.fsGroupChangePolicySupported() {
+		ext.Logger.Debugf("Ignoring fs group change policy %s of POD %s, as the cluster doesn't support it", policy, pod.Name)
+		return nil
+	}
+
+	p := corev1.PodFSGroupChangePolicy(policy)
+	sc.FSGroupChangePolicy = &p
+	return nil
+}
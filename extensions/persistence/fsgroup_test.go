@@ -0,0 +1,136 @@
+package persistence_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/version"
+
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("FSGroupChangePolicy", func() {
+	var (
+		env testing.Catalog
+		ctx context.Context
+		ext *persistence.Extension
+	)
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		ext = &persistence.Extension{
+			Logger:      eirinixcat.SimpleManager().GetLogger(),
+			KubeVersion: &version.Info{GitVersion: "v1.20.2"},
+			Options: persistence.Options{
+				SecurityContextMode: persistence.SecurityContextMinimal,
+				FSGroupChangePolicy: "OnRootMismatch",
+			},
+		}
+	})
+
+	It("sets the policy of the options", func() {
+		pod := env.SimplePersiApp("foo")
+
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(*pod.Spec.SecurityContext.FSGroupChangePolicy).To(Equal(corev1.FSGroupChangeOnRootMismatch))
+	})
+
+	It("prefers the policy of the bindings", func() {
+		ext.Options.FSGroupChangePolicy = ""
+		pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo", "mount_config": {"fs_group_change_policy": "Always"}}]}]}`)
+
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(*pod.Spec.SecurityContext.FSGroupChangePolicy).To(Equal(corev1.FSGroupChangeAlways))
+	})
+
+	It("returns an error for invalid policies of the bindings", func() {
+		pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo", "mount_config": {"fs_group_change_policy": "Never"}}]}]}`)
+
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(MatchError(ContainSubstring(`invalid fs group change policy "Never"`)))
+	})
+
+	It("is ignored on older clusters", func() {
+		ext.KubeVersion = &version.Info{GitVersion: "v1.18.6"}
+		pod := env.SimplePersiApp("foo")
+
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.SecurityContext.FSGroup).ToNot(BeNil())
+		Expect(pod.Spec.SecurityContext.FSGroupChangePolicy).To(BeNil())
+	})
+
+	It("is ignored if the cluster version is unknown", func() {
+		ext.KubeVersion = nil
+		pod := env.SimplePersiApp("foo")
+
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.SecurityContext.FSGroupChangePolicy).To(BeNil())
+	})
+
+	It("is ignored if the pod has no fs group", func() {
+		ext.Options.SecurityContextMode = persistence.SecurityContextSupplemental
+		pod := env.SimplePersiApp("foo")
+
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.SecurityContext.FSGroupChangePolicy).To(BeNil())
+	})
+
+	It("does not override the policy of the pod", func() {
+		always := corev1.FSGroupChangeAlways
+		pod := env.SimplePersiApp("foo")
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{FSGroupChangePolicy: &always}
+
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(*pod.Spec.SecurityContext.FSGroupChangePolicy).To(Equal(corev1.FSGroupChangeAlways))
+	})
+
+	It("looks up the cluster version once for concurrent requests", func() {
+		var lookups int32
+		ext.KubeVersion = nil
+		ext.KubeVersionLookup = func() (*version.Info, error) {
+			atomic.AddInt32(&lookups, 1)
+			return &version.Info{GitVersion: "v1.21.0"}, nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				pod := env.SimplePersiApp("foo")
+				Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+				Expect(*pod.Spec.SecurityContext.FSGroupChangePolicy).To(Equal(corev1.FSGroupChangeOnRootMismatch))
+			}()
+		}
+		wg.Wait()
+		Expect(atomic.LoadInt32(&lookups)).To(Equal(int32(1)))
+	})
+
+	It("does not look up the cluster version again after a failure", func() {
+		lookups := 0
+		ext.KubeVersion = nil
+		ext.KubeVersionLookup = func() (*version.Info, error) {
+			lookups++
+			return nil, errors.New("connection refused")
+		}
+
+		for i := 0; i < 3; i++ {
+			pod := env.SimplePersiApp("foo")
+			Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+			Expect(pod.Spec.SecurityContext.FSGroupChangePolicy).To(BeNil())
+		}
+		Expect(lookups).To(Equal(1))
+	})
+
+	It("rejects invalid policies in the options", func() {
+		Expect(persistence.Options{FSGroupChangePolicy: "Sometimes"}.Validate()).To(HaveOccurred())
+	})
+})
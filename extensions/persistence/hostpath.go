@@ -0,0 +1,50 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// VolumeKindHostPath mounts a directory of the node, for single node development clusters
+	VolumeKindHostPath = "hostpath"
+	// HostPathPlan is the plan of the services mounted as host paths when Options.HostPathVolumes is enabled
+	HostPathPlan = "hostpath"
+	// DefaultHostPathRoot is the node directory containing the host path volumes if none is given in the options
+	DefaultHostPathRoot = "/tmp/eirini-persi"
+)
+
+// validateHostPathRoot returns an error if host path volumes are enabled with a relative root
+func validateHostPathRoot(o Options) error {
+	if o.HostPathVolumes && o.HostPathRoot != "" && !path.IsAbs(o.HostPathRoot) {
+		return fmt.Errorf("invalid host path root %q: must be an absolute path", o.HostPathRoot)
+	}
+	return nil
+}
+
+// hostPathVolumeSource returns the source of the host path volume of the service: a directory named after
+// its volume id, under the root of the options. It returns an error unless host path volumes are enabled.
+func (s VcapService) hostPathVolumeSource(opts Options) (corev1.VolumeSource, error) {
+	if !opts.HostPathVolumes {
+		return corev1.VolumeSource{}, fmt.Errorf("host path volumes are disabled, volume %s can't be mounted", s.Credentials.VolumeID)
+	}
+	if s.Credentials.VolumeID == "" {
+		return corev1.VolumeSource{}, errors.New("missing volume_id for host path volume")
+	}
+
+	root := opts.HostPathRoot
+	if root == "" {
+		root = DefaultHostPathRoot
+	}
+	hostPathType := corev1.HostPathDirectoryOrCreate
+	return corev1.VolumeSource{
+		HostPath: &corev1.HostPathVolumeSource{
+			// The volume name is a safe directory name, whatever the volume id
+			Path: path.Join(root, VolumeName(s.Credentials.VolumeID)),
+			Type: &hostPathType,
+		},
+	}, nil
+}
@@ -0,0 +1,92 @@
+package persistence_test
+
+import (
+	"context"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	cfakes "code.cloudfoundry.org/eirini-persi/pkg/controllers/fakes"
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Host path volumes", func() {
+	var (
+		env testing.Catalog
+		ctx context.Context
+		ext *persistence.Extension
+	)
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		ext = &persistence.Extension{
+			Logger:  eirinixcat.SimpleManager().GetLogger(),
+			Options: persistence.Options{HostPathVolumes: true, HostPathRoot: "/data/volumes"},
+		}
+	})
+
+	It("mounts a directory per volume id under the root", func() {
+		pod := env.SimplePersiApp("foo")
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		Expect(pod.Spec.Volumes[0].Name).To(Equal("the-volume-id"))
+		Expect(pod.Spec.Volumes[0].PersistentVolumeClaim).To(BeNil())
+		Expect(pod.Spec.Volumes[0].HostPath.Path).To(Equal("/data/volumes/the-volume-id"))
+		Expect(*pod.Spec.Volumes[0].HostPath.Type).To(Equal(corev1.HostPathDirectoryOrCreate))
+	})
+
+	It("keeps volume ids from escaping the root", func() {
+		pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"plan": "hostpath", "credentials": {"volume_id": "../../etc"}, "volume_mounts": [{"container_dir": "/data"}]}]}`)
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes[0].HostPath.Path).To(HavePrefix("/data/volumes/etc-"))
+	})
+
+	It("mounts claims for other plans", func() {
+		pod := env.ProvisionedPersiApp("foo")
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes[0].HostPath).To(BeNil())
+		Expect(pod.Spec.Volumes[0].PersistentVolumeClaim).ToNot(BeNil())
+	})
+
+	It("does not look up claims", func() {
+		client := &cfakes.FakeClient{}
+		ext.Client = client
+		pod := env.SimplePersiApp("foo")
+
+		problems, err := ext.ValidateClaims(ctx, "eirini", &pod)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(problems).To(BeEmpty())
+		Expect(client.GetCallCount()).To(Equal(0))
+	})
+
+	Context("when disabled", func() {
+		BeforeEach(func() {
+			ext.Options.HostPathVolumes = false
+		})
+
+		It("mounts claims for the hostpath plan", func() {
+			pod := env.SimplePersiApp("foo")
+
+			Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+			Expect(pod.Spec.Volumes[0].HostPath).To(BeNil())
+			Expect(pod.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("the-volume-id"))
+		})
+
+		It("rejects the hostpath kind", func() {
+			pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"kind": "hostpath", "volume_id": "the-volume-id"}, "volume_mounts": [{"container_dir": "/data"}]}]}`)
+
+			Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(MatchError("host path volumes are disabled, volume the-volume-id can't be mounted"))
+		})
+	})
+
+	It("requires an absolute root", func() {
+		Expect(persistence.Options{HostPathVolumes: true, HostPathRoot: "volumes"}.Validate()).To(MatchError(ContainSubstring(`invalid host path root "volumes"`)))
+	})
+})
@@ -0,0 +1,134 @@
+package persistence_test
+
+import (
+	"context"
+	"encoding/json"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinix "code.cloudfoundry.org/eirinix"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	jsonpatch "github.com/evanphx/json-patch"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/version"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cfakes "code.cloudfoundry.org/eirini-persi/pkg/controllers/fakes"
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Idempotency", func() {
+	var (
+		eiriniManager eirinix.Manager
+		ctx           context.Context
+		env           testing.Catalog
+	)
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		eiriniManager = eirinixcat.SimpleManager()
+	})
+
+	// mutate returns the pod patched by the extension
+	mutate := func(ext *persistence.Extension, pod corev1.Pod) corev1.Pod {
+		raw, err := json.Marshal(&pod)
+		Expect(err).ToNot(HaveOccurred())
+		request := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Namespace: "eirini"}}
+		request.Object.Raw = raw
+
+		resp := ext.Handle(ctx, eiriniManager, &pod, request)
+		Expect(resp.Allowed).To(BeTrue(), "%v", resp.Result)
+
+		ops, err := json.Marshal(resp.Patches)
+		Expect(err).ToNot(HaveOccurred())
+		patch, err := jsonpatch.DecodePatch(ops)
+		Expect(err).ToNot(HaveOccurred())
+		patched, err := patch.Apply(raw)
+		Expect(err).ToNot(HaveOccurred())
+
+		var patchedPod corev1.Pod
+		Expect(json.Unmarshal(patched, &patchedPod)).To(Succeed())
+		return patchedPod
+	}
+
+	table.DescribeTable("reaches a fixed point when the webhook is invoked again",
+		func(opts persistence.Options, pod corev1.Pod) {
+			ext := &persistence.Extension{
+				Options:     opts,
+				Client:      &cfakes.FakeClient{},
+				KubeVersion: &version.Info{GitVersion: "v1.20.0"},
+			}
+
+			once := mutate(ext, pod)
+			Expect(once).ToNot(Equal(pod))
+			twice := mutate(ext, once)
+			Expect(twice).To(Equal(once))
+			Expect(twice.Spec.Volumes).To(HaveLen(len(once.Spec.Volumes)))
+		},
+		table.Entry("with a single volume", persistence.Options{}, env.SimplePersiApp("foo")),
+		table.Entry("with several volumes", persistence.Options{}, env.MultipleVolumePersiApp("foo")),
+		table.Entry("with several mounts of a volume", persistence.Options{MountConflictPolicy: persistence.MountConflictReject}, env.MultipleMountsPersiApp("foo")),
+		table.Entry("with provisioned claims", persistence.Options{}, env.ProvisionedPersiApp("foo")),
+		table.Entry("with per instance sub paths",
+			persistence.Options{},
+			env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo", "mount_config": {"sub_path": "data", "per_instance": true}}]}]}`)),
+		table.Entry("with renamed volumes",
+			persistence.Options{},
+			env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "Volume_1"}, "volume_mounts": [{"container_dir": "/foo"}]}]}`)),
+		table.Entry("with skipped conflicting mounts",
+			persistence.Options{MountConflictPolicy: persistence.MountConflictSkip},
+			env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/data"}]}, {"credentials": {"volume_id": "bar"}, "volume_mounts": [{"container_dir": "/data/bar"}]}]}`)),
+		table.Entry("with the last-wins conflict policy",
+			persistence.Options{MountConflictPolicy: persistence.MountConflictLastWins},
+			env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/data"}]}, {"credentials": {"volume_id": "bar"}, "volume_mounts": [{"container_dir": "/data"}]}]}`)),
+		table.Entry("with the minimal security context and an fs group change policy",
+			persistence.Options{SecurityContextMode: persistence.SecurityContextMinimal, FSGroupChangePolicy: "OnRootMismatch"},
+			env.SimplePersiApp("foo")),
+		table.Entry("with supplemental groups", persistence.Options{SecurityContextMode: persistence.SecurityContextSupplemental}, env.SimplePersiApp("foo")),
+		table.Entry("with the ownership init container", persistence.Options{SecurityContextMode: persistence.SecurityContextInitContainer}, env.MultipleMountsPersiApp("foo")),
+		table.Entry("with NFS shares",
+			persistence.Options{ServiceLabels: []string{"nfs"}},
+			env.DefaultEiriniAppPod("foo", `{"nfs": [{"credentials": {"mount_config": {"source": "nfs.example.com:/exports", "uid": "1000", "gid": "1000"}}, "volume_mounts": [{"container_dir": "/data"}]}]}`)),
+		table.Entry("with SMB shares",
+			persistence.Options{ServiceLabels: []string{"smb"}},
+			env.DefaultEiriniAppPod("foo", `{"smb": [{"credentials": {"share": "//smb.example.com/data", "username": "alice", "password": "secret"}, "volume_mounts": [{"container_dir": "/data"}]}]}`)),
+		table.Entry("with scratch volumes",
+			persistence.Options{},
+			env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"kind": "scratch", "size_limit": "1Gi", "medium": "Memory"}, "volume_mounts": [{"container_dir": "/scratch"}]}]}`)),
+		table.Entry("with host path volumes", persistence.Options{HostPathVolumes: true}, env.SimplePersiApp("foo")),
+		table.Entry("with mount targets", persistence.Options{MountTargetPolicy: persistence.MountTargetAll}, withSidecar(env.SimplePersiApp("foo"))),
+		table.Entry("with a volume of the same name added by another extension", persistence.Options{}, withVolume(env.SimplePersiApp("foo"), corev1.Volume{
+			Name:         "the-volume-id",
+			VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "the-volume-id"}},
+		})),
+	)
+
+	It("adds the volume of mounts added by another extension", func() {
+		ext := &persistence.Extension{Client: &cfakes.FakeClient{}}
+		pod := env.SimplePersiApp("foo")
+		pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "the-volume-id", MountPath: "/var/vcap/data/de847d34-bdcc-4c5d-92b1-cf2158a15b47"}}
+
+		once := mutate(ext, pod)
+		Expect(once.Spec.Volumes).To(HaveLen(1))
+		Expect(once.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("the-volume-id"))
+		Expect(once.Spec.Containers[0].VolumeMounts).To(HaveLen(1))
+		Expect(mutate(ext, once)).To(Equal(once))
+	})
+})
+
+// withSidecar returns the pod given as argument with a sidecar and an init container
+func withSidecar(pod corev1.Pod) corev1.Pod {
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "log-shipper", Image: "fluentd"})
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, corev1.Container{Name: "migrate", Image: "migrations"})
+	return pod
+}
+
+// withVolume returns the pod given as argument with an additional volume
+func withVolume(pod corev1.Pod, volume corev1.Volume) corev1.Pod {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+	return pod
+}
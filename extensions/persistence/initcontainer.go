@@ -0,0 +1,95 @@
+package persistence
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// SecurityContextInitContainer leaves the pod security context alone, and changes the ownership of the
+	// mount points in an init container instead, for storage which ignores the fs group (e.g. NFS or hostPath)
+	SecurityContextInitContainer = "init-container"
+
+	// OwnershipInitContainerName is the name of the init container changing the ownership of the mount points
+	OwnershipInitContainerName = "eirini-persi-ownership"
+
+	// DefaultInitImage is the image of the ownership init container if none is given in the options
+	DefaultInitImage = "busybox"
+
+	// ownershipScript changes the owner given as $0 of the mount points given as arguments, and makes them group writable
+	ownershipScript = `chown "$0" "$@" && chmod ug+rwx "$@"`
+)
+
+// ownershipInitContainer returns the init container changing the ownership of the writable mounts given as argument
+func (o Options) ownershipInitContainer(mounts []corev1.VolumeMount, uid, gid int64) corev1.Container {
+	image := o.InitImage
+	if image == "" {
+		image = DefaultInitImage
+	}
+
+	args := []string{"-c", ownershipScript, fmt.Sprintf("%d:%d", uid, gid)}
+	for _, m := range mounts {
+		args = append(args, m.MountPath)
+	}
+
+	c := corev1.Container{
+		Name:         OwnershipInitContainerName,
+		Image:        image,
+		Command:      []string{"sh"},
+		Args:         args,
+		VolumeMounts: mounts,
+		Resources:    o.InitResources,
+	}
+	if o.InitSecurityContext != nil {
+		c.SecurityContext = o.InitSecurityContext.DeepCopy()
+	}
+	return c
+}
+
+// setOwnershipInitContainer adds, or replaces, the init container changing the ownership of the volumes
+// of the services mounted in the container given as argument. Read-only mounts are skipped.
+func (ext *Extension) setOwnershipInitContainer(pod *corev1.Pod, c *corev1.Container, services []VcapService, uid, gid int64) {
+	volumes := map[string]bool{}
+	for _, service := range services {
+		volumes[VolumeName(service.volumeID())] = true
+	}
+
+	var mounts []corev1.VolumeMount
+	for _, m := range c.VolumeMounts {
+		if volumes[m.Name] && !m.ReadOnly {
+			mounts = append(mounts, m)
+		}
+	}
+
+	removeOwnershipInitContainer(pod)
+	if len(mounts) > 0 {
+		// The ownership is fixed before any other init container runs
+		c := ext.Options.ownershipInitContainer(mounts, uid, gid)
+		if mountsNeedPodName(mounts) {
+			appendPodNameEnv(&c)
+		}
+		pod.Spec.InitContainers = append([]corev1.Container{c}, pod.Spec.InitContainers...)
+	}
+}
+
+// removeOwnershipInitContainer removes the init container changing the ownership of the volumes from the pod
+func removeOwnershipInitContainer(pod *corev1.Pod) {
+	var initContainers []corev1.Container
+	for _, ic := range pod.Spec.InitContainers {
+		if ic.Name != OwnershipInitContainerName {
+			initContainers = append(initContainers, ic)
+		}
+	}
+	pod.Spec.InitContainers = initContainers
+}
+
+// mountsNeedPodName returns true if a mount expands the pod name in its sub path
+func mountsNeedPodName(mounts []corev1.VolumeMount) bool {
+	for _, m := range mounts {
+		if m.SubPathExpr != "" {
+			return true
+		}
+	}
+	return false
+}
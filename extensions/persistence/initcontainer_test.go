@@ -0,0 +1,104 @@
+package persistence_test
+
+import (
+	"context"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Ownership init container", func() {
+	var (
+		env testing.Catalog
+		ctx context.Context
+		ext *persistence.Extension
+	)
+	id := func(i int64) *int64 { return &i }
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		ext = &persistence.Extension{
+			Logger: eirinixcat.SimpleManager().GetLogger(),
+			Options: persistence.Options{
+				SecurityContextMode: persistence.SecurityContextInitContainer,
+				OwnershipStrategy:   persistence.OwnershipFixed,
+				OwnerUID:            id(1000),
+				OwnerGID:            id(1001),
+			},
+		}
+	})
+
+	mount := func(pod *corev1.Pod) {
+		Expect(ext.MountVcapVolumes(ctx, "eirini", pod)).To(Succeed())
+		Expect(ext.SetOwnership(ctx, "eirini", pod)).To(Succeed())
+	}
+
+	It("changes the owner of the mount points", func() {
+		pod := env.MultipleMountsPersiApp("foo")
+		mount(&pod)
+
+		Expect(pod.Spec.SecurityContext).To(BeNil())
+		Expect(pod.Spec.InitContainers).To(HaveLen(1))
+		c := pod.Spec.InitContainers[0]
+		Expect(c.Name).To(Equal(persistence.OwnershipInitContainerName))
+		Expect(c.Image).To(Equal(persistence.DefaultInitImage))
+		Expect(c.Command).To(Equal([]string{"sh"}))
+		Expect(c.Args[2:]).To(Equal([]string{"1000:1001", "/var/vcap/data/data", "/var/vcap/data/logs"}))
+		Expect(c.VolumeMounts).To(Equal(pod.Spec.Containers[0].VolumeMounts))
+	})
+
+	It("uses the image, resources and security context of the options", func() {
+		resources := corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10m")}}
+		ext.Options.InitImage = "alpine"
+		ext.Options.InitResources = resources
+		ext.Options.InitSecurityContext = &corev1.SecurityContext{RunAsUser: id(0)}
+		pod := env.SimplePersiApp("foo")
+		mount(&pod)
+
+		c := pod.Spec.InitContainers[0]
+		Expect(c.Image).To(Equal("alpine"))
+		Expect(c.Resources).To(Equal(resources))
+		Expect(*c.SecurityContext.RunAsUser).To(Equal(int64(0)))
+	})
+
+	It("skips read-only mounts", func() {
+		pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo", "mode": "r"}]}, {"credentials": {"volume_id": "bar"}, "volume_mounts": [{"container_dir": "/bar"}]}]}`)
+		mount(&pod)
+
+		Expect(pod.Spec.InitContainers[0].Args[3:]).To(Equal([]string{"/bar"}))
+		Expect(pod.Spec.InitContainers[0].VolumeMounts).To(HaveLen(1))
+	})
+
+	It("is not added if every mount is read-only", func() {
+		pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo", "mode": "r"}]}]}`)
+		mount(&pod)
+
+		Expect(pod.Spec.InitContainers).To(BeEmpty())
+	})
+
+	It("runs before the other init containers and is only added once", func() {
+		pod := env.SimplePersiApp("foo")
+		pod.Spec.InitContainers = []corev1.Container{{Name: "setup", Image: "busybox"}}
+		mount(&pod)
+		mount(&pod)
+
+		Expect(pod.Spec.InitContainers).To(HaveLen(2))
+		Expect(pod.Spec.InitContainers[0].Name).To(Equal(persistence.OwnershipInitContainerName))
+		Expect(pod.Spec.InitContainers[1].Name).To(Equal("setup"))
+	})
+
+	It("exposes the pod name to per instance sub paths", func() {
+		pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo", "mount_config": {"per_instance": true}}]}]}`)
+		mount(&pod)
+
+		Expect(pod.Spec.InitContainers[0].VolumeMounts[0].SubPathExpr).To(Equal("$(POD_NAME)"))
+		Expect(pod.Spec.InitContainers[0].Env[0].Name).To(Equal(persistence.PodNameEnv))
+	})
+})
@@ -0,0 +1,375 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// InjectedAnnotation is the pod annotation recording the volumes and mounts injected by the extension, so that they can
+// be removed when the services declaring them disappear from VCAP_SERVICES
+const InjectedAnnotation = "eirini-persi.cloudfoundry.org/injected"
+
+// injectedRecord is what the extension injected in a pod: its volumes, their mounts by container, identified as
+// name:path, and the changes made to the containers and to the pod for them
+type injectedRecord struct {
+	Volumes []string            `json:"volumes,omitempty"`
+	Mounts  map[string][]string `json:"mounts,omitempty"`
+	// Resources are the requests and limits added for the scratch volumes, by volume and container
+	Resources map[string]map[string]corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Env are the environment variables added to the containers, by container
+	Env map[string][]string `json:"env,omitempty"`
+	// SecurityContext holds the fields of the pod security context set by the extension
+	SecurityContext *corev1.PodSecurityContext `json:"securityContext,omitempty"`
+	// Annotations are the pod annotations set by the extension
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// podVolumes is the set of the volumes, and of the mounts by container, of a pod
+type podVolumes struct {
+	volumes sets.String
+	mounts  map[string]sets.String
+}
+
+// mountKey returns the identifier of a volume mount in a container
+func mountKey(m corev1.VolumeMount) string {
+	return m.Name + ":" + m.MountPath
+}
+
+// newPodVolumes returns an empty set of volumes and mounts
+func newPodVolumes() podVolumes {
+	return podVolumes{volumes: sets.NewString(), mounts: map[string]sets.String{}}
+}
+
+// volumesOf returns the volumes of the pod, and the mounts of its containers and init containers
+func volumesOf(pod *corev1.Pod) podVolumes {
+	v := newPodVolumes()
+	for _, volume := range pod.Spec.Volumes {
+		v.volumes.Insert(volume.Name)
+	}
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			for _, m := range c.VolumeMounts {
+				v.addMount(c.Name, mountKey(m))
+			}
+		}
+	}
+	return v
+}
+
+// addMount adds the mount given as argument to the mounts of the container
+func (v podVolumes) addMount(container, key string) {
+	if v.mounts[container] == nil {
+		v.mounts[container] = sets.NewString()
+	}
+	v.mounts[container].Insert(key)
+}
+
+// difference returns the volumes and mounts which are not in the set given as argument
+func (v podVolumes) difference(o podVolumes) podVolumes {
+	d := newPodVolumes()
+	d.volumes = v.volumes.Difference(o.volumes)
+	for container, mounts := range v.mounts {
+		other := o.mounts[container]
+		if other == nil {
+			other = sets.NewString()
+		}
+		for _, key := range mounts.Difference(other).List() {
+			d.addMount(container, key)
+		}
+	}
+	return d
+}
+
+// empty returns true if there are neither volumes nor mounts in the set
+func (v podVolumes) empty() bool {
+	for _, mounts := range v.mounts {
+		if mounts.Len() > 0 {
+			return false
+		}
+	}
+	return v.volumes.Len() == 0
+}
+
+// readInjected returns what is recorded in the InjectedAnnotation of the pod
+func readInjected(pod *corev1.Pod) (injectedRecord, error) {
+	var record injectedRecord
+	annotation, ok := pod.Annotations[InjectedAnnotation]
+	if !ok {
+		return record, nil
+	}
+	if err := json.Unmarshal([]byte(annotation), &record); err != nil {
+		return injectedRecord{}, fmt.Errorf("invalid annotation %s: %w", InjectedAnnotation, err)
+	}
+	return record, nil
+}
+
+// writeInjected sets the InjectedAnnotation of the pod to the record given as argument, or removes it if it is empty
+func writeInjected(pod *corev1.Pod, record injectedRecord) error {
+	if len(record.Volumes) == 0 && len(record.Mounts) == 0 && len(record.Resources) == 0 && len(record.Env) == 0 &&
+		record.SecurityContext == nil && len(record.Annotations) == 0 {
+		delete(pod.Annotations, InjectedAnnotation)
+		return nil
+	}
+	annotation, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	setAnnotation(pod, InjectedAnnotation, string(annotation))
+	return nil
+}
+
+// volumes returns the recorded volumes and mounts
+func (r injectedRecord) volumes() podVolumes {
+	v := newPodVolumes()
+	v.volumes.Insert(r.Volumes...)
+	for container, mounts := range r.Mounts {
+		for _, key := range mounts {
+			v.addMount(container, key)
+		}
+	}
+	return v
+}
+
+// setVolumes records the volumes and mounts given as argument
+func (r *injectedRecord) setVolumes(v podVolumes) {
+	r.Volumes, r.Mounts = nil, nil
+	if v.volumes.Len() > 0 {
+		r.Volumes = v.volumes.List()
+	}
+	for container, mounts := range v.mounts {
+		if mounts.Len() == 0 {
+			continue
+		}
+		if r.Mounts == nil {
+			r.Mounts = map[string][]string{}
+		}
+		r.Mounts[container] = mounts.List()
+	}
+}
+
+// recordInjectedResources records the requests and limits added to the container for the volume
+func recordInjectedResources(pod *corev1.Pod, volume, container string, added corev1.ResourceRequirements) error {
+	if len(added.Requests) == 0 && len(added.Limits) == 0 {
+		return nil
+	}
+	record, err := readInjected(pod)
+	if err != nil {
+		return err
+	}
+	if record.Resources == nil {
+		record.Resources = map[string]map[string]corev1.ResourceRequirements{}
+	}
+	if record.Resources[volume] == nil {
+		record.Resources[volume] = map[string]corev1.ResourceRequirements{}
+	}
+	record.Resources[volume][container] = added
+	return writeInjected(pod, record)
+}
+
+// recordInjectedEnv records the environment variable added to the container
+func recordInjectedEnv(pod *corev1.Pod, container, name string) error {
+	record, err := readInjected(pod)
+	if err != nil {
+		return err
+	}
+	if record.Env == nil {
+		record.Env = map[string][]string{}
+	}
+	record.Env[container] = append(record.Env[container], name)
+	return writeInjected(pod, record)
+}
+
+// containersByName returns the containers and init containers of the pod by name
+func containersByName(pod *corev1.Pod) map[string]*corev1.Container {
+	containers := map[string]*corev1.Container{}
+	for _, list := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range list {
+			containers[list[i].Name] = &list[i]
+		}
+	}
+	return containers
+}
+
+// revertContainerChanges releases the resources requested for the volumes given as argument, and removes the
+// injected environment variables of the containers whose mounts no longer need the pod name
+func revertContainerChanges(pod *corev1.Pod, volumes []string) error {
+	record, err := readInjected(pod)
+	if err != nil {
+		return err
+	}
+	containers := containersByName(pod)
+	for _, volume := range volumes {
+		for container, added := range record.Resources[volume] {
+			if c, ok := containers[container]; ok {
+				releaseResources(c, added)
+			}
+		}
+		delete(record.Resources, volume)
+	}
+
+	for container, names := range record.Env {
+		c, ok := containers[container]
+		if ok && mountsNeedPodName(c.VolumeMounts) {
+			continue
+		}
+		if ok {
+			injectedEnv := sets.NewString(names...)
+			var env []corev1.EnvVar
+			for _, e := range c.Env {
+				if !injectedEnv.Has(e.Name) {
+					env = append(env, e)
+				}
+			}
+			c.Env = env
+		}
+		delete(record.Env, container)
+	}
+	return writeInjected(pod, record)
+}
+
+// removeVolumes removes the volumes and mounts given as argument from the pod, with the resources and environment
+// variables injected for them, and their volume ids from its annotation
+func removeVolumes(pod *corev1.Pod, v podVolumes) error {
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			c := &containers[i]
+			stale := v.mounts[c.Name]
+			if stale == nil {
+				continue
+			}
+			var mounts []corev1.VolumeMount
+			for _, m := range c.VolumeMounts {
+				if !stale.Has(mountKey(m)) {
+					mounts = append(mounts, m)
+				}
+			}
+			c.VolumeMounts = mounts
+		}
+	}
+
+	var volumes []corev1.Volume
+	for _, volume := range pod.Spec.Volumes {
+		if !v.volumes.Has(volume.Name) {
+			volumes = append(volumes, volume)
+		}
+	}
+	pod.Spec.Volumes = volumes
+	if err := revertContainerChanges(pod, v.volumes.List()); err != nil {
+		return err
+	}
+	return forgetVolumeIDs(pod, v.volumes.List())
+}
+
+// securityContextChanges returns the fields of the security context which were set since the copy given as argument
+func securityContextChanges(before, after *corev1.PodSecurityContext) *corev1.PodSecurityContext {
+	if after == nil {
+		return nil
+	}
+	if before == nil {
+		before = &corev1.PodSecurityContext{}
+	}
+	changes := &corev1.PodSecurityContext{}
+	if before.RunAsUser == nil {
+		changes.RunAsUser = after.RunAsUser
+	}
+	if before.RunAsGroup == nil {
+		changes.RunAsGroup = after.RunAsGroup
+	}
+	if before.FSGroup == nil {
+		changes.FSGroup = after.FSGroup
+	}
+	if before.FSGroupChangePolicy == nil {
+		changes.FSGroupChangePolicy = after.FSGroupChangePolicy
+	}
+	if added := sets.NewInt64(after.SupplementalGroups...).Difference(sets.NewInt64(before.SupplementalGroups...)); added.Len() > 0 {
+		changes.SupplementalGroups = added.List()
+	}
+	if reflect.DeepEqual(changes, &corev1.PodSecurityContext{}) {
+		return nil
+	}
+	return changes
+}
+
+// revertSecurityContext unsets the fields of the pod security context given as argument, unless they were changed since.
+// The security context is removed if nothing is left
+func revertSecurityContext(pod *corev1.Pod, changes *corev1.PodSecurityContext) {
+	sc := pod.Spec.SecurityContext
+	if sc == nil || changes == nil {
+		return
+	}
+	if sameID(sc.RunAsUser, changes.RunAsUser) {
+		sc.RunAsUser = nil
+	}
+	if sameID(sc.RunAsGroup, changes.RunAsGroup) {
+		sc.RunAsGroup = nil
+	}
+	if sameID(sc.FSGroup, changes.FSGroup) {
+		sc.FSGroup = nil
+	}
+	if sc.FSGroupChangePolicy != nil && changes.FSGroupChangePolicy != nil && *sc.FSGroupChangePolicy == *changes.FSGroupChangePolicy {
+		sc.FSGroupChangePolicy = nil
+	}
+	injectedGroups := sets.NewInt64(changes.SupplementalGroups...)
+	var groups []int64
+	for _, g := range sc.SupplementalGroups {
+		if !injectedGroups.Has(g) {
+			groups = append(groups, g)
+		}
+	}
+	sc.SupplementalGroups = groups
+	if reflect.DeepEqual(sc, &corev1.PodSecurityContext{}) {
+		pod.Spec.SecurityContext = nil
+	}
+}
+
+// sameID returns true if both ids are set and equal
+func sameID(a, b *int64) bool {
+	return a != nil && b != nil && *a == *b
+}
+
+// SyncVcapVolumes mounts the volumes of the services declared in VCAP_SERVICES, like MountVcapVolumes, and removes
+// the volumes and mounts it injected earlier for services which are no longer declared. Injected volumes and mounts
+// are recorded in the InjectedAnnotation of the pod, the ones added by other components are left alone.
+func (ext *Extension) SyncVcapVolumes(ctx context.Context, namespace string, pod *corev1.Pod) error {
+	services, err := ext.resolveServices(ctx, namespace, pod)
+	if err != nil {
+		return err
+	}
+	return ext.syncVolumes(namespace, pod, services)
+}
+
+// syncVolumes syncs the volumes of the services given as argument, as SyncVcapVolumes does
+func (ext *Extension) syncVolumes(namespace string, pod *corev1.Pod, services appServices) error {
+	record, err := readInjected(pod)
+	if err != nil {
+		return err
+	}
+	injected := record.volumes()
+
+	// The injected volumes and mounts are rebuilt from the services currently declared, so that changes of their
+	// mode, size or credentials are applied as well
+	if err := removeVolumes(pod, injected); err != nil {
+		return err
+	}
+	before := volumesOf(pod)
+	if err := ext.mountServices(pod, services); err != nil {
+		return err
+	}
+	added := volumesOf(pod).difference(before)
+	if stale := injected.difference(added); !stale.empty() {
+		ext.Logger.Infof("Removing volumes %v of POD %s (%s) which are no longer declared", stale.volumes.List(), pod.Name, namespace)
+	}
+
+	// The resources and environment variables injected while mounting are recorded as well
+	record, err = readInjected(pod)
+	if err != nil {
+		return err
+	}
+	record.setVolumes(added)
+	return writeInjected(pod, record)
+}
@@ -0,0 +1,207 @@
+package persistence_test
+
+import (
+	"context"
+	"encoding/json"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinix "code.cloudfoundry.org/eirinix"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Injected volumes", func() {
+	var (
+		eiriniManager eirinix.Manager
+		env           testing.Catalog
+		ctx           context.Context
+		ext           *persistence.Extension
+		pod           corev1.Pod
+	)
+
+	twoServices := `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo"}]}, {"credentials": {"volume_id": "Bar_1"}, "volume_mounts": [{"container_dir": "/bar"}]}]}`
+	oneService := `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo"}]}]}`
+
+	// setServices replaces the VCAP_SERVICES of the app container, as an updated template would
+	setServices := func(pod *corev1.Pod, vcapServices string) {
+		pod.Spec.Containers[0].Env[0].Value = vcapServices
+	}
+
+	volumeNames := func(pod corev1.Pod) []string {
+		var names []string
+		for _, v := range pod.Spec.Volumes {
+			names = append(names, v.Name)
+		}
+		return names
+	}
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		eiriniManager = eirinixcat.SimpleManager()
+		ext = &persistence.Extension{Logger: eiriniManager.GetLogger()}
+		pod = env.DefaultEiriniAppPod("foo", twoServices)
+		pod.Spec.Volumes = []corev1.Volume{{Name: "other", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+		pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "other", MountPath: "/other"}}
+	})
+
+	It("records the volumes and mounts it injects", func() {
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+
+		var injected map[string]interface{}
+		Expect(json.Unmarshal([]byte(pod.Annotations[persistence.InjectedAnnotation]), &injected)).To(Succeed())
+		barName := persistence.VolumeName("Bar_1")
+		Expect(injected).To(Equal(map[string]interface{}{
+			"volumes": []interface{}{barName, "foo"},
+			"mounts":  map[string]interface{}{"busybox": []interface{}{barName + ":/bar", "foo:/foo"}},
+		}))
+	})
+
+	It("removes the volumes of the services which are no longer declared", func() {
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		setServices(&pod, oneService)
+
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(volumeNames(pod)).To(Equal([]string{"other", "foo"}))
+		Expect(pod.Spec.Containers[0].VolumeMounts).To(Equal([]corev1.VolumeMount{{Name: "other", MountPath: "/other"}, {Name: "foo", MountPath: "/foo"}}))
+		Expect(pod.Annotations[persistence.InjectedAnnotation]).To(Equal(`{"volumes":["foo"],"mounts":{"busybox":["foo:/foo"]}}`))
+		Expect(pod.Annotations).ToNot(HaveKey(persistence.VolumeIDsAnnotation))
+	})
+
+	It("moves mounts whose container_dir changed", func() {
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		setServices(&pod, `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/data"}]}]}`)
+
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(volumeNames(pod)).To(Equal([]string{"other", "foo"}))
+		Expect(pod.Spec.Containers[0].VolumeMounts).To(Equal([]corev1.VolumeMount{{Name: "other", MountPath: "/other"}, {Name: "foo", MountPath: "/data"}}))
+	})
+
+	It("leaves the volumes added by other components alone", func() {
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		setServices(&pod, `{}`)
+
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(volumeNames(pod)).To(Equal([]string{"other"}))
+		Expect(pod.Spec.Containers[0].VolumeMounts).To(Equal([]corev1.VolumeMount{{Name: "other", MountPath: "/other"}}))
+		Expect(pod.Annotations).ToNot(HaveKey(persistence.InjectedAnnotation))
+	})
+
+	It("does not claim matching volumes added by other components", func() {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: "foo", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "foo"}}})
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		setServices(&pod, `{}`)
+
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(volumeNames(pod)).To(Equal([]string{"other", "foo"}))
+	})
+
+	It("removes the ownership init container with the last service", func() {
+		ext.Options.SecurityContextMode = persistence.SecurityContextInitContainer
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.InitContainers).To(HaveLen(1))
+		setServices(&pod, `{}`)
+
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.InitContainers).To(BeEmpty())
+	})
+
+	It("reverts the security context and the ownership annotation with the last service", func() {
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.SecurityContext).ToNot(BeNil())
+		setServices(&pod, `{}`)
+
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.SecurityContext).To(BeNil())
+		Expect(pod.Annotations).ToNot(HaveKey(persistence.OwnershipAnnotation))
+		Expect(pod.Annotations).ToNot(HaveKey(persistence.InjectedAnnotation))
+	})
+
+	It("keeps the security context set by the app", func() {
+		uid, groups := int64(1000), []int64{10}
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: &uid, SupplementalGroups: groups}
+		ext.Options.SecurityContextMode = persistence.SecurityContextSupplemental
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.SecurityContext.SupplementalGroups).To(Equal([]int64{10, 1000}))
+		setServices(&pod, `{}`)
+
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.SecurityContext).To(Equal(&corev1.PodSecurityContext{RunAsUser: &uid, SupplementalGroups: groups}))
+	})
+
+	It("sets the security context again when the owner changes", func() {
+		ext.Options.SecurityContextMode = persistence.SecurityContextMinimal
+		setServices(&pod, `{"nfs": [{"credentials": {"mount_config": {"source": "nfs.example.com:/exports", "uid": "1000", "gid": "1000"}}, "volume_mounts": [{"container_dir": "/data"}]}]}`)
+		ext.Options.ServiceLabels = []string{"nfs"}
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		setServices(&pod, `{"nfs": [{"credentials": {"mount_config": {"source": "nfs.example.com:/exports", "uid": "1001", "gid": "1001"}}, "volume_mounts": [{"container_dir": "/data"}]}]}`)
+
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		id := int64(1001)
+		Expect(pod.Spec.SecurityContext).To(Equal(&corev1.PodSecurityContext{FSGroup: &id, SupplementalGroups: []int64{1001}}))
+		Expect(pod.Annotations).To(HaveKeyWithValue(persistence.OwnershipAnnotation, "1001:1001"))
+	})
+
+	It("releases the space requested for the scratch volumes which are removed", func() {
+		pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{corev1.ResourceEphemeralStorage: resource.MustParse("500Mi")}
+		setServices(&pod, `{"eirini-persi": [{"credentials": {"kind": "scratch", "size_limit": "1Gi"}, "volume_mounts": [{"container_dir": "/scratch"}]}, {"credentials": {"kind": "scratch", "size_limit": "1Gi", "medium": "Memory"}, "volume_mounts": [{"container_dir": "/tmpfs"}]}]}`)
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		requests := pod.Spec.Containers[0].Resources.Requests
+		Expect(requests.StorageEphemeral().String()).To(Equal("1524Mi"))
+		Expect(requests.Memory().String()).To(Equal("1Gi"))
+		setServices(&pod, `{"eirini-persi": [{"credentials": {"kind": "scratch", "size_limit": "1Gi"}, "volume_mounts": [{"container_dir": "/scratch"}]}]}`)
+
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		requests = pod.Spec.Containers[0].Resources.Requests
+		Expect(requests.StorageEphemeral().String()).To(Equal("1524Mi"))
+		Expect(requests).ToNot(HaveKey(corev1.ResourceMemory))
+		setServices(&pod, `{}`)
+
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Containers[0].Resources.Requests.StorageEphemeral().String()).To(Equal("500Mi"))
+		Expect(pod.Annotations).ToNot(HaveKey(persistence.InjectedAnnotation))
+	})
+
+	It("removes the pod name environment variable with the last per instance mount", func() {
+		setServices(&pod, `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo"}]}, {"credentials": {"volume_id": "bar"}, "volume_mounts": [{"container_dir": "/bar", "mount_config": {"per_instance": true}}]}]}`)
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Containers[0].Env).To(HaveLen(2))
+		setServices(&pod, oneService)
+
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Containers[0].Env).To(HaveLen(1))
+		Expect(pod.Spec.Containers[0].Env[0].Name).To(Equal(persistence.VcapServicesEnv))
+	})
+
+	It("rejects invalid annotations", func() {
+		pod.Annotations = map[string]string{persistence.InjectedAnnotation: "foo"}
+
+		Expect(ext.SyncVcapVolumes(ctx, "eirini", &pod)).To(MatchError(ContainSubstring("invalid annotation " + persistence.InjectedAnnotation)))
+	})
+
+	It("leaves pod updates alone, as the pod spec is immutable", func() {
+		setServices(&pod, oneService)
+		raw, _ := json.Marshal(&pod)
+		request := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Namespace: "eirini", Operation: admissionv1beta1.Update}}
+		request.Object.Raw = raw
+
+		resp := ext.Handle(ctx, eiriniManager, &pod, request)
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Patches).To(BeEmpty())
+	})
+})
@@ -0,0 +1,119 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VolumeKindInstanceClaim mounts a claim dedicated to each instance of the app, created from a claim template
+// of its StatefulSet
+const VolumeKindInstanceClaim = "instance-claim"
+
+// PerInstanceClaim is a claim created for each instance of the app, which follows the instance when it is rescheduled
+type PerInstanceClaim struct {
+	// Size is the size of the claims
+	Size string `json:"size"`
+	// StorageClass is the storage class of the claims. The default storage class is used if empty
+	StorageClass string `json:"storage_class"`
+}
+
+// instanceClaimVolumeSource returns the source of the volume of the service, which stands in for the claim template
+// in the pod template until it is moved to the StatefulSet
+func (s VcapService) instanceClaimVolumeSource(readOnly bool, opts Options) (corev1.VolumeSource, error) {
+	if !opts.StatefulSetMode {
+		return corev1.VolumeSource{}, fmt.Errorf("per instance claim of volume %s requires the statefulset mode", s.Credentials.VolumeID)
+	}
+	if s.Credentials.VolumeID == "" {
+		return corev1.VolumeSource{}, errors.New("missing volume_id for per instance claim")
+	}
+	if s.Credentials.MountConfig.PerInstanceClaim == nil {
+		return corev1.VolumeSource{}, fmt.Errorf("missing per_instance_claim in the mount_config of volume %s", s.Credentials.VolumeID)
+	}
+	return corev1.VolumeSource{
+		PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+			ClaimName: VolumeName(s.Credentials.VolumeID),
+			ReadOnly:  readOnly,
+		},
+	}, nil
+}
+
+// claimTemplate returns the claim template of the per instance claim of the service. Instances get the claim
+// named after the template, the StatefulSet and their ordinal
+func (s VcapService) claimTemplate(pod *corev1.Pod) (corev1.PersistentVolumeClaim, error) {
+	perInstanceClaim := s.Credentials.MountConfig.PerInstanceClaim
+	size, err := resource.ParseQuantity(perInstanceClaim.Size)
+	if err != nil {
+		return corev1.PersistentVolumeClaim{}, fmt.Errorf("invalid size %q for per instance claim %s: %w", perInstanceClaim.Size, s.Credentials.VolumeID, err)
+	}
+
+	labels := map[string]string{ProvisionedLabel: "true"}
+	for _, key := range []string{AppGUIDLabel, SpaceGUIDLabel} {
+		if v := podMetadata(pod, key); v != "" {
+			labels[key] = v
+		}
+	}
+
+	claim := corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   VolumeName(s.Credentials.VolumeID),
+			Labels: labels,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+			},
+		},
+	}
+	if perInstanceClaim.StorageClass != "" {
+		claim.Spec.StorageClassName = &perInstanceClaim.StorageClass
+	}
+	return claim, nil
+}
+
+// findClaimTemplate returns the claim template with the given name, or nil if there is none
+func findClaimTemplate(templates []corev1.PersistentVolumeClaim, name string) *corev1.PersistentVolumeClaim {
+	for i := range templates {
+		if templates[i].Name == name {
+			return &templates[i]
+		}
+	}
+	return nil
+}
+
+// setClaimTemplates moves the volumes of the per instance claims from the pod template of the StatefulSet to its
+// claim templates. Claim templates of existing StatefulSets can't be changed, so only the ones they already have
+// can be mounted, and the ones of services no longer declared are kept
+func (ext *Extension) setClaimTemplates(namespace string, statefulSet *appsv1.StatefulSet, services []VcapService, existing bool) error {
+	template := &statefulSet.Spec.Template
+	pod := &corev1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}
+
+	for _, service := range services {
+		if service.kind() != VolumeKindInstanceClaim {
+			continue
+		}
+		name := VolumeName(service.Credentials.VolumeID)
+		removeVolume(pod, name)
+
+		if findClaimTemplate(statefulSet.Spec.VolumeClaimTemplates, name) != nil {
+			continue
+		}
+		if existing {
+			return fmt.Errorf("per instance claim %s can't be added to the existing StatefulSet %s, the app has to be restaged", service.Credentials.VolumeID, statefulSet.Name)
+		}
+		claim, err := service.claimTemplate(pod)
+		if err != nil {
+			return err
+		}
+		ext.Logger.Infof("Adding claim template %s to StatefulSet %s (%s)", claim.Name, statefulSet.Name, namespace)
+		statefulSet.Spec.VolumeClaimTemplates = append(statefulSet.Spec.VolumeClaimTemplates, claim)
+	}
+
+	template.Spec = pod.Spec
+	return nil
+}
@@ -0,0 +1,139 @@
+package persistence_test
+
+import (
+	"context"
+	"encoding/json"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinix "code.cloudfoundry.org/eirinix"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	jsonpatch "github.com/evanphx/json-patch"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cfakes "code.cloudfoundry.org/eirini-persi/pkg/controllers/fakes"
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Per instance claims", func() {
+	var (
+		eiriniManager eirinix.Manager
+		ctx           context.Context
+		env           testing.Catalog
+		mutator       *persistence.StatefulSetMutator
+	)
+
+	instanceClaim := `{"eirini-persi": [{"credentials": {"volume_id": "Cache_1", "mount_config": {"per_instance_claim": {"size": "2Gi", "storage_class": "fast"}}}, "volume_mounts": [{"container_dir": "/cache"}]}]}`
+	cacheName := persistence.VolumeName("Cache_1")
+
+	// handle returns the response of the mutator to the admission of the StatefulSet, and the patched StatefulSet
+	handle := func(statefulSet appsv1.StatefulSet, operation admissionv1beta1.Operation) (admission.Response, appsv1.StatefulSet) {
+		raw, err := json.Marshal(&statefulSet)
+		Expect(err).ToNot(HaveOccurred())
+		request := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Namespace: "eirini", Operation: operation}}
+		request.Object.Raw = raw
+
+		resp := mutator.Handle(ctx, request)
+		if !resp.Allowed {
+			return resp, statefulSet
+		}
+		ops, err := json.Marshal(resp.Patches)
+		Expect(err).ToNot(HaveOccurred())
+		patch, err := jsonpatch.DecodePatch(ops)
+		Expect(err).ToNot(HaveOccurred())
+		patched, err := patch.Apply(raw)
+		Expect(err).ToNot(HaveOccurred())
+
+		var patchedStatefulSet appsv1.StatefulSet
+		Expect(json.Unmarshal(patched, &patchedStatefulSet)).To(Succeed())
+		return resp, patchedStatefulSet
+	}
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		eiriniManager = eirinixcat.SimpleManager()
+		mutator = &persistence.StatefulSetMutator{Extension: &persistence.Extension{
+			Logger:  eiriniManager.GetLogger(),
+			Client:  &cfakes.FakeClient{},
+			Options: persistence.Options{StatefulSetMode: true, ClaimValidation: persistence.ClaimValidationDeny},
+		}}
+		decoder, err := admission.NewDecoder(scheme.Scheme)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mutator.InjectDecoder(decoder)).To(Succeed())
+	})
+
+	It("adds a claim template to new StatefulSets", func() {
+		statefulSet := env.EiriniAppStatefulSet("foo", instanceClaim)
+		statefulSet.Spec.Template.Labels[persistence.AppGUIDLabel] = "app-guid"
+
+		resp, statefulSet := handle(statefulSet, admissionv1beta1.Create)
+		Expect(resp.Allowed).To(BeTrue(), "%v", resp.Result)
+
+		Expect(statefulSet.Spec.VolumeClaimTemplates).To(HaveLen(1))
+		claim := statefulSet.Spec.VolumeClaimTemplates[0]
+		Expect(claim.Name).To(Equal(cacheName))
+		Expect(claim.Labels).To(Equal(map[string]string{persistence.ProvisionedLabel: "true", persistence.AppGUIDLabel: "app-guid"}))
+		Expect(claim.Spec.AccessModes).To(Equal([]corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}))
+		Expect(claim.Spec.Resources.Requests[corev1.ResourceStorage]).To(Equal(resource.MustParse("2Gi")))
+		Expect(*claim.Spec.StorageClassName).To(Equal("fast"))
+
+		Expect(statefulSet.Spec.Template.Spec.Volumes).To(BeEmpty())
+		Expect(statefulSet.Spec.Template.Spec.Containers[0].VolumeMounts).To(Equal([]corev1.VolumeMount{{Name: cacheName, MountPath: "/cache"}}))
+	})
+
+	It("reaches a fixed point when the StatefulSet is updated again", func() {
+		_, once := handle(env.EiriniAppStatefulSet("foo", instanceClaim), admissionv1beta1.Create)
+		resp, twice := handle(once, admissionv1beta1.Update)
+		Expect(resp.Allowed).To(BeTrue(), "%v", resp.Result)
+		Expect(twice).To(Equal(once))
+	})
+
+	It("keeps the claim templates of the services no longer declared", func() {
+		_, statefulSet := handle(env.EiriniAppStatefulSet("foo", instanceClaim), admissionv1beta1.Create)
+		statefulSet.Spec.Template.Spec.Containers[0].Env[0].Value = `{"eirini-persi": []}`
+
+		resp, statefulSet := handle(statefulSet, admissionv1beta1.Update)
+		Expect(resp.Allowed).To(BeTrue(), "%v", resp.Result)
+		Expect(statefulSet.Spec.VolumeClaimTemplates).To(HaveLen(1))
+		Expect(statefulSet.Spec.Template.Spec.Containers[0].VolumeMounts).To(BeEmpty())
+	})
+
+	It("rejects per instance claims added to existing StatefulSets", func() {
+		resp, _ := handle(env.EiriniAppStatefulSet("foo", instanceClaim), admissionv1beta1.Update)
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(resp.Result.Code).To(Equal(int32(400)))
+		Expect(resp.Result.Message).To(ContainSubstring("can't be added to the existing StatefulSet foo"))
+	})
+
+	It("rejects per instance claims with an invalid size", func() {
+		resp, _ := handle(env.EiriniAppStatefulSet("foo", `{"eirini-persi": [{"credentials": {"volume_id": "cache", "mount_config": {"per_instance_claim": {"size": "big"}}}, "volume_mounts": [{"container_dir": "/cache"}]}]}`), admissionv1beta1.Create)
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(resp.Result.Message).To(ContainSubstring(`invalid size "big" for per instance claim cache`))
+	})
+
+	It("rejects the instance-claim kind without per_instance_claim", func() {
+		resp, _ := handle(env.EiriniAppStatefulSet("foo", `{"eirini-persi": [{"credentials": {"volume_id": "cache", "kind": "instance-claim"}, "volume_mounts": [{"container_dir": "/cache"}]}]}`), admissionv1beta1.Create)
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(resp.Result.Message).To(ContainSubstring("missing per_instance_claim in the mount_config of volume cache"))
+	})
+
+	It("rejects pods with per instance claims outside of the StatefulSet mode", func() {
+		ext := &persistence.Extension{Client: &cfakes.FakeClient{}}
+		pod := env.DefaultEiriniAppPod("foo", instanceClaim)
+		raw, err := json.Marshal(&pod)
+		Expect(err).ToNot(HaveOccurred())
+		request := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Namespace: "eirini"}}
+		request.Object.Raw = raw
+
+		resp := ext.Handle(ctx, eiriniManager, &pod, request)
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(resp.Result.Message).To(ContainSubstring("per instance claim of volume Cache_1 requires the statefulset mode"))
+	})
+})
@@ -0,0 +1,108 @@
+package persistence
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// VolumeIDsAnnotation is the pod annotation mapping the names of the volumes which differ from their volume ids
+const VolumeIDsAnnotation = "eirini-persi.cloudfoundry.org/volume-ids"
+
+// volumeNameHashLength is the length of the hash appended to sanitized volume names
+const volumeNameHashLength = 8
+
+// setAnnotation sets an annotation on the pod given as argument
+func setAnnotation(pod *corev1.Pod, key, value string) {
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[key] = value
+}
+
+// VolumeName returns a valid pod volume name (a DNS-1123 label) for the volume id given as argument.
+// Valid volume ids are returned unchanged, others are lowercased, stripped of invalid characters,
+// truncated, and suffixed with a hash of the volume id to avoid collisions.
+func VolumeName(volumeID string) string {
+	if len(validation.IsDNS1123Label(volumeID)) == 0 {
+		return volumeID
+	}
+
+	sum := sha256.Sum256([]byte(volumeID))
+	hash := hex.EncodeToString(sum[:])[:volumeNameHashLength]
+
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, volumeID)
+
+	maxLength := validation.DNS1123LabelMaxLength - volumeNameHashLength - 1
+	if len(name) > maxLength {
+		name = name[:maxLength]
+	}
+	name = strings.Trim(name, "-")
+	if name == "" {
+		name = "volume"
+	}
+	return name + "-" + hash
+}
+
+// recordVolumeID annotates the pod with the volume id of the volume name given as argument, if they differ
+func recordVolumeID(pod *corev1.Pod, name, volumeID string) error {
+	if name == volumeID {
+		return nil
+	}
+
+	volumeIDs := map[string]string{}
+	if annotation, ok := pod.Annotations[VolumeIDsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(annotation), &volumeIDs); err != nil {
+			return err
+		}
+	}
+	if volumeIDs[name] == volumeID {
+		return nil
+	}
+	volumeIDs[name] = volumeID
+
+	annotation, err := json.Marshal(volumeIDs)
+	if err != nil {
+		return err
+	}
+	setAnnotation(pod, VolumeIDsAnnotation, string(annotation))
+	return nil
+}
+
+// forgetVolumeIDs removes the volume names given as argument from the volume ids annotation of the pod
+func forgetVolumeIDs(pod *corev1.Pod, names []string) error {
+	annotation, ok := pod.Annotations[VolumeIDsAnnotation]
+	if !ok {
+		return nil
+	}
+	volumeIDs := map[string]string{}
+	if err := json.Unmarshal([]byte(annotation), &volumeIDs); err != nil {
+		return err
+	}
+	for _, name := range names {
+		delete(volumeIDs, name)
+	}
+	if len(volumeIDs) == 0 {
+		delete(pod.Annotations, VolumeIDsAnnotation)
+		return nil
+	}
+
+	updated, err := json.Marshal(volumeIDs)
+	if err != nil {
+		return err
+	}
+	setAnnotation(pod, VolumeIDsAnnotation, string(updated))
+	return nil
+}
@@ -0,0 +1,78 @@
+package persistence_test
+
+import (
+	"strings"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Volume names", func() {
+	var env testing.Catalog
+
+	Describe("VolumeName", func() {
+		It("keeps valid volume ids", func() {
+			Expect(persistence.VolumeName("the-volume-id")).To(Equal("the-volume-id"))
+		})
+
+		It("sanitizes uppercase letters and underscores", func() {
+			name := persistence.VolumeName("The_Volume_ID")
+			Expect(validation.IsDNS1123Label(name)).To(BeEmpty())
+			Expect(name).To(HavePrefix("the-volume-id-"))
+		})
+
+		It("truncates long volume ids", func() {
+			name := persistence.VolumeName(strings.Repeat("a", 100))
+			Expect(validation.IsDNS1123Label(name)).To(BeEmpty())
+			Expect(len(name)).To(Equal(63))
+		})
+
+		It("generates names for volume ids without valid characters", func() {
+			name := persistence.VolumeName("___")
+			Expect(validation.IsDNS1123Label(name)).To(BeEmpty())
+			Expect(name).To(HavePrefix("volume-"))
+		})
+
+		It("generates different names for volume ids which sanitize to the same name", func() {
+			Expect(persistence.VolumeName("Volume_A")).ToNot(Equal(persistence.VolumeName("volume-a")))
+			Expect(persistence.VolumeName("Volume_A")).ToNot(Equal(persistence.VolumeName("VOLUME_A")))
+		})
+
+		It("is deterministic", func() {
+			Expect(persistence.VolumeName("Volume_A")).To(Equal(persistence.VolumeName("Volume_A")))
+		})
+	})
+
+	Describe("AppendMounts", func() {
+		It("uses sanitized volume names and keeps the volume id as claim name", func() {
+			var services persistence.VcapServices
+			pod := env.DefaultEiriniAppPod("bar", ``)
+			services.ServiceMap = append(services.ServiceMap, persistence.VcapService{
+				Credentials:  persistence.Credentials{VolumeID: "The_Volume_ID"},
+				VolumeMounts: []persistence.VolumeMount{persistence.VolumeMount{ContainerDir: "/foo/"}},
+			})
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})).To(Succeed())
+			name := persistence.VolumeName("The_Volume_ID")
+			Expect(pod.Spec.Volumes[0].Name).To(Equal(name))
+			Expect(pod.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("The_Volume_ID"))
+			Expect(pod.Spec.Containers[0].VolumeMounts[0].Name).To(Equal(name))
+			Expect(pod.Annotations).To(HaveKeyWithValue("eirini-persi.cloudfoundry.org/volume-ids", `{"`+name+`":"The_Volume_ID"}`))
+		})
+
+		It("does not annotate pods whose volume names are the volume ids", func() {
+			pod := env.DefaultEiriniAppPod("bar", ``)
+			services := persistence.VcapServices{ServiceMap: []persistence.VcapService{{
+				Credentials:  persistence.Credentials{VolumeID: "foo"},
+				VolumeMounts: []persistence.VolumeMount{persistence.VolumeMount{ContainerDir: "/foo/"}},
+			}}}
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})).To(Succeed())
+			Expect(pod.Annotations).ToNot(HaveKey("eirini-persi.cloudfoundry.org/volume-ids"))
+		})
+	})
+})
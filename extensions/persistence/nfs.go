@@ -0,0 +1,92 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// nfsVersions are the NFS versions accepted in the mount_config of the bindings
+var nfsVersions = map[string]bool{"3": true, "4": true, "4.0": true, "4.1": true, "4.2": true}
+
+// parseNFSSource returns the server and the exported path of an NFS source, given either as server:/export
+// or, as nfs-volume-release does, as nfs://server/export
+func parseNFSSource(source string) (string, string, error) {
+	var server, export string
+	if strings.HasPrefix(source, "nfs://") {
+		u, err := url.Parse(source)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid nfs source %q: %w", source, err)
+		}
+		server, export = u.Host, u.Path
+	} else if i := strings.Index(source, ":"); i >= 0 {
+		server, export = source[:i], source[i+1:]
+	}
+	if server == "" || !strings.HasPrefix(export, "/") {
+		return "", "", fmt.Errorf("invalid nfs source %q: must be server:/export or nfs://server/export", source)
+	}
+	return server, export, nil
+}
+
+// nfsVolumeSource returns the volume source of the NFS share of the service.
+// The version is checked but left to the node to negotiate, as NFS volumes have no mount options.
+func (s VcapService) nfsVolumeSource(readOnly bool) (corev1.VolumeSource, error) {
+	config := s.Credentials.MountConfig
+	server, export, err := parseNFSSource(config.Source)
+	if err != nil {
+		return corev1.VolumeSource{}, err
+	}
+	if config.Version != "" && !nfsVersions[config.Version] {
+		return corev1.VolumeSource{}, fmt.Errorf("invalid nfs version %q for source %s", config.Version, config.Source)
+	}
+	return corev1.VolumeSource{
+		NFS: &corev1.NFSVolumeSource{
+			Server:   server,
+			Path:     export,
+			ReadOnly: readOnly,
+		},
+	}, nil
+}
+
+// nfsOwnership returns the owner declared by the NFS bindings, whose files are owned by the uid and gid the app has to use
+func nfsOwnership(ctx context.Context, req OwnershipRequest) (Ownership, error) {
+	var services []VcapService
+	for _, service := range req.Services {
+		if service.kind() == VolumeKindNFS {
+			services = append(services, service)
+		}
+	}
+	req.Services = services
+	return BindingOwnership{}.Resolve(ctx, req)
+}
+
+// applyNFSOwnership makes sure the pod can write on the NFS shares owned by the user and group declared by their
+// bindings, as NFS shares ignore the fs group. The group is added to the supplemental groups, and only the legacy
+// mode also runs the pod as this user and group when the security context doesn't set them
+func applyNFSOwnership(pod *corev1.Pod, o Ownership, mode string) {
+	if pod.Spec.SecurityContext == nil {
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{}
+	}
+	sc := pod.Spec.SecurityContext
+	legacy := mode == "" || mode == SecurityContextLegacy
+	if legacy && o.UID != nil && sc.RunAsUser == nil {
+		uid := *o.UID
+		sc.RunAsUser = &uid
+	}
+	if o.GID == nil {
+		return
+	}
+	gid := *o.GID
+	if legacy && sc.RunAsGroup == nil {
+		sc.RunAsGroup = &gid
+	}
+	for _, g := range sc.SupplementalGroups {
+		if g == gid {
+			return
+		}
+	}
+	sc.SupplementalGroups = append(sc.SupplementalGroups, gid)
+}
@@ -0,0 +1,132 @@
+package persistence_test
+
+import (
+	"context"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	cfakes "code.cloudfoundry.org/eirini-persi/pkg/controllers/fakes"
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("NFS volumes", func() {
+	var (
+		env testing.Catalog
+		ctx context.Context
+		ext *persistence.Extension
+	)
+
+	nfsApp := func(source, mode string) corev1.Pod {
+		return env.DefaultEiriniAppPod("foo", `{"nfs": [{"credentials": {"mount_config": {"source": "`+source+`", "version": "4.1", "uid": "1000", "gid": 1001}}, "volume_mounts": [{"container_dir": "/data", "mode": "`+mode+`"}]}]}`)
+	}
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		ext = &persistence.Extension{
+			Logger:  eirinixcat.SimpleManager().GetLogger(),
+			Options: persistence.Options{ServiceLabels: []string{"nfs"}, SecurityContextMode: persistence.SecurityContextLegacy},
+		}
+	})
+
+	It("mounts the share of bindings without volume id", func() {
+		pod := nfsApp("nfs.example.com:/exports/data", "rw")
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		Expect(pod.Spec.Volumes[0].PersistentVolumeClaim).To(BeNil())
+		Expect(*pod.Spec.Volumes[0].NFS).To(Equal(corev1.NFSVolumeSource{Server: "nfs.example.com", Path: "/exports/data"}))
+		Expect(pod.Spec.Containers[0].VolumeMounts[0].Name).To(Equal(pod.Spec.Volumes[0].Name))
+		Expect(pod.Spec.Containers[0].VolumeMounts[0].MountPath).To(Equal("/data"))
+		Expect(pod.Annotations[persistence.VolumeIDsAnnotation]).To(ContainSubstring("nfs.example.com:/exports/data"))
+	})
+
+	It("accepts nfs-volume-release sources", func() {
+		pod := nfsApp("nfs://nfs.example.com/exports/data", "r")
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(*pod.Spec.Volumes[0].NFS).To(Equal(corev1.NFSVolumeSource{Server: "nfs.example.com", Path: "/exports/data", ReadOnly: true}))
+		Expect(pod.Spec.Containers[0].VolumeMounts[0].ReadOnly).To(BeTrue())
+	})
+
+	It("prefers the claim of bindings with a volume id", func() {
+		pod := env.DefaultEiriniAppPod("foo", `{"nfs": [{"credentials": {"volume_id": "the-volume-id", "mount_config": {"source": "nfs.example.com:/exports"}}, "volume_mounts": [{"container_dir": "/data"}]}]}`)
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes[0].NFS).To(BeNil())
+		Expect(pod.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("the-volume-id"))
+	})
+
+	It("rejects invalid sources and versions", func() {
+		pod := nfsApp("nfs.example.com", "rw")
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(MatchError(ContainSubstring(`invalid nfs source "nfs.example.com"`)))
+
+		pod = env.DefaultEiriniAppPod("foo", `{"nfs": [{"credentials": {"mount_config": {"source": "nfs.example.com:/exports", "version": "2"}}, "volume_mounts": [{"container_dir": "/data"}]}]}`)
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(MatchError(ContainSubstring(`invalid nfs version "2"`)))
+	})
+
+	It("resolves the owner from the uid and gid of the binding", func() {
+		ext.Options.OwnershipStrategy = persistence.OwnershipFixed
+		pod := nfsApp("nfs.example.com:/exports/data", "rw")
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(*pod.Spec.SecurityContext.RunAsUser).To(Equal(int64(1000)))
+		Expect(*pod.Spec.SecurityContext.RunAsGroup).To(Equal(int64(1001)))
+		Expect(pod.Annotations).To(HaveKeyWithValue(persistence.OwnershipAnnotation, "1000:1001"))
+	})
+
+	It("lets pods running as another user write in legacy mode", func() {
+		pod := nfsApp("nfs.example.com:/exports/data", "rw")
+		uid := int64(2000)
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: &uid}
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(*pod.Spec.SecurityContext.RunAsUser).To(Equal(int64(2000)))
+		Expect(*pod.Spec.SecurityContext.RunAsGroup).To(Equal(int64(1001)))
+		Expect(pod.Spec.SecurityContext.SupplementalGroups).To(Equal([]int64{1001}))
+	})
+
+	It("only adds the group of the share to the supplemental groups in minimal and supplemental modes", func() {
+		for _, mode := range []string{persistence.SecurityContextMinimal, persistence.SecurityContextSupplemental} {
+			ext.Options.SecurityContextMode = mode
+			pod := nfsApp("nfs.example.com:/exports/data", "rw")
+
+			Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+			Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+			Expect(pod.Spec.SecurityContext.RunAsUser).To(BeNil(), mode)
+			Expect(pod.Spec.SecurityContext.RunAsGroup).To(BeNil(), mode)
+			Expect(pod.Spec.SecurityContext.SupplementalGroups).To(Equal([]int64{1001}), mode)
+		}
+	})
+
+	It("changes the owner of the mount points of the share in init-container mode", func() {
+		ext.Options.SecurityContextMode = persistence.SecurityContextInitContainer
+		pod := nfsApp("nfs.example.com:/exports/data", "rw")
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.SecurityContext).To(BeNil())
+		Expect(pod.Spec.InitContainers).To(HaveLen(1))
+		Expect(pod.Spec.InitContainers[0].Args[2:]).To(Equal([]string{"1000:1001", "/data"}))
+	})
+
+	It("is neither provisioned nor validated as a claim", func() {
+		client := &cfakes.FakeClient{}
+		ext.Client = client
+		pod := nfsApp("nfs.example.com:/exports/data", "rw")
+
+		claims, err := ext.ProvisionClaims(ctx, "eirini", &pod)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(claims).To(BeEmpty())
+		problems, err := ext.ValidateClaims(ctx, "eirini", &pod)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(problems).To(BeEmpty())
+		Expect(client.GetCallCount()).To(Equal(0))
+	})
+})
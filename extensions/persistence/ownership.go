@@ -0,0 +1,342 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// OwnershipGuess guesses the owner from the pod security context
+	OwnershipGuess = "guess"
+	// OwnershipFixed uses the owner given in the options
+	OwnershipFixed = "fixed"
+	// OwnershipNamespaceAnnotation reads the owner from the UIDAnnotation and GIDAnnotation of the app namespace
+	OwnershipNamespaceAnnotation = "namespace-annotation"
+	// OwnershipPodAnnotation reads the owner from the UIDAnnotation and GIDAnnotation of the pod
+	OwnershipPodAnnotation = "pod-annotation"
+	// OwnershipBinding reads the owner from the uid and gid of the mount_config of the bindings
+	OwnershipBinding = "binding"
+	// OwnershipContainer reads the owner from the security context of the app container
+	OwnershipContainer = "container"
+
+	// UIDAnnotation is the namespace or pod annotation with the user owning the volumes
+	UIDAnnotation = "eirini-persi.cloudfoundry.org/uid"
+	// GIDAnnotation is the namespace or pod annotation with the group owning the volumes
+	GIDAnnotation = "eirini-persi.cloudfoundry.org/gid"
+	// OwnershipAnnotation is the pod annotation recording the resolved owner of the volumes, as uid:gid
+	OwnershipAnnotation = "eirini-persi.cloudfoundry.org/ownership"
+
+	// DefaultVcapID is the best guess for the vcap user and group ids
+	DefaultVcapID = int64(2000)
+
+	// SecurityContextLegacy sets the run as user and group of pods without security context, and their fs group
+	SecurityContextLegacy = "legacy"
+	// SecurityContextMinimal only sets the fs group of the pod, leaving the run as identity alone
+	SecurityContextMinimal = "minimal"
+	// SecurityContextSupplemental only adds the group to the supplemental groups of the pod
+	SecurityContextSupplemental = "supplemental"
+)
+
+// Ownership is the user and group owning the volumes of an app. Ids which are not resolved are nil
+type Ownership struct {
+	UID *int64
+	GID *int64
+}
+
+// OwnershipRequest contains what is needed to resolve the owner of the volumes mounted in a container
+type OwnershipRequest struct {
+	// Client is used to look up the namespace
+	Client    client.Reader
+	Namespace string
+	Pod       *corev1.Pod
+	Container *corev1.Container
+	Services  []VcapService
+}
+
+// OwnershipResolver resolves the owner of the volumes mounted in a container
+type OwnershipResolver interface {
+	Resolve(ctx context.Context, req OwnershipRequest) (Ownership, error)
+}
+
+// GuessOwnership resolves the owner from the run as user and group of the pod security context
+type GuessOwnership struct{}
+
+// Resolve implements OwnershipResolver
+func (GuessOwnership) Resolve(_ context.Context, req OwnershipRequest) (Ownership, error) {
+	sc := req.Pod.Spec.SecurityContext
+	if sc == nil {
+		return Ownership{}, nil
+	}
+	o := Ownership{UID: sc.RunAsUser, GID: sc.RunAsGroup}
+	if o.GID == nil {
+		// Normally uid == gid for vcap user
+		o.GID = sc.RunAsUser
+	}
+	return o, nil
+}
+
+// FixedOwnership resolves the owner to fixed ids
+type FixedOwnership struct {
+	UID *int64
+	GID *int64
+}
+
+// Resolve implements OwnershipResolver
+func (f FixedOwnership) Resolve(_ context.Context, _ OwnershipRequest) (Ownership, error) {
+	return Ownership{UID: f.UID, GID: f.GID}, nil
+}
+
+// NamespaceAnnotationOwnership resolves the owner from the annotations of the app namespace
+type NamespaceAnnotationOwnership struct{}
+
+// Resolve implements OwnershipResolver
+func (NamespaceAnnotationOwnership) Resolve(ctx context.Context, req OwnershipRequest) (Ownership, error) {
+	if req.Client == nil {
+		return Ownership{}, errors.New("no kubernetes client available to look up the namespace")
+	}
+	namespace := &corev1.Namespace{}
+	if err := req.Client.Get(ctx, types.NamespacedName{Name: req.Namespace}, namespace); err != nil {
+		return Ownership{}, fmt.Errorf("looking up namespace %s: %w", req.Namespace, err)
+	}
+	return annotationOwnership(namespace.Annotations)
+}
+
+// PodAnnotationOwnership resolves the owner from the annotations of the pod
+type PodAnnotationOwnership struct{}
+
+// Resolve implements OwnershipResolver
+func (PodAnnotationOwnership) Resolve(_ context.Context, req OwnershipRequest) (Ownership, error) {
+	return annotationOwnership(req.Pod.Annotations)
+}
+
+// BindingOwnership resolves the owner from the mount_config of the first binding declaring a uid or a gid,
+// in its volume mounts or in its credentials
+type BindingOwnership struct{}
+
+// Resolve implements OwnershipResolver
+func (BindingOwnership) Resolve(_ context.Context, req OwnershipRequest) (Ownership, error) {
+	for _, service := range req.Services {
+		configs := []MountConfig{}
+		for _, volumeMount := range service.VolumeMounts {
+			configs = append(configs, volumeMount.MountConfig)
+		}
+		configs = append(configs, service.Credentials.MountConfig)
+
+		for _, config := range configs {
+			uid, err := parseID(config.UID.String())
+			if err != nil {
+				return Ownership{}, err
+			}
+			gid, err := parseID(config.GID.String())
+			if err != nil {
+				return Ownership{}, err
+			}
+			if uid != nil || gid != nil {
+				return Ownership{UID: uid, GID: gid}, nil
+			}
+		}
+	}
+	return Ownership{}, nil
+}
+
+// ContainerOwnership resolves the owner from the run as user and group of the container security context
+type ContainerOwnership struct{}
+
+// Resolve implements OwnershipResolver
+func (ContainerOwnership) Resolve(_ context.Context, req OwnershipRequest) (Ownership, error) {
+	sc := req.Container.SecurityContext
+	if sc == nil {
+		return Ownership{}, nil
+	}
+	return Ownership{UID: sc.RunAsUser, GID: sc.RunAsGroup}, nil
+}
+
+// parseID parses a user or group id, returning nil if empty
+func parseID(id string) (*int64, error) {
+	if id == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || v < 0 {
+		return nil, fmt.Errorf("invalid user or group id %q", id)
+	}
+	return &v, nil
+}
+
+func annotationOwnership(annotations map[string]string) (Ownership, error) {
+	uid, err := parseID(annotations[UIDAnnotation])
+	if err != nil {
+		return Ownership{}, fmt.Errorf("annotation %s: %w", UIDAnnotation, err)
+	}
+	gid, err := parseID(annotations[GIDAnnotation])
+	if err != nil {
+		return Ownership{}, fmt.Errorf("annotation %s: %w", GIDAnnotation, err)
+	}
+	return Ownership{UID: uid, GID: gid}, nil
+}
+
+// validateSecurityContextMode returns an error if the security context mode is unknown
+func validateSecurityContextMode(mode string) error {
+	switch mode {
+	case "", SecurityContextLegacy, SecurityContextMinimal, SecurityContextSupplemental, SecurityContextInitContainer:
+		return nil
+	}
+	return fmt.Errorf("invalid security context mode %q: must be %q, %q, %q or %q", mode,
+		SecurityContextLegacy, SecurityContextMinimal, SecurityContextSupplemental, SecurityContextInitContainer)
+}
+
+// ownershipResolver returns the resolver of the ownership strategy of the options
+func (o Options) ownershipResolver() (OwnershipResolver, error) {
+	switch o.OwnershipStrategy {
+	case "", OwnershipGuess:
+		return GuessOwnership{}, nil
+	case OwnershipFixed:
+		return FixedOwnership{UID: o.OwnerUID, GID: o.OwnerGID}, nil
+	case OwnershipNamespaceAnnotation:
+		return NamespaceAnnotationOwnership{}, nil
+	case OwnershipPodAnnotation:
+		return PodAnnotationOwnership{}, nil
+	case OwnershipBinding:
+		return BindingOwnership{}, nil
+	case OwnershipContainer:
+		return ContainerOwnership{}, nil
+	}
+	return nil, fmt.Errorf("invalid ownership strategy %q: must be %q, %q, %q, %q, %q or %q", o.OwnershipStrategy,
+		OwnershipGuess, OwnershipFixed, OwnershipNamespaceAnnotation, OwnershipPodAnnotation, OwnershipBinding, OwnershipContainer)
+}
+
+// withDefaults returns the ownership with the ids which are not resolved set to the defaults of the options
+func (o Ownership) withDefaults(opts Options) (int64, int64) {
+	uid, gid := DefaultVcapID, DefaultVcapID
+	if opts.OwnerUID != nil {
+		uid = *opts.OwnerUID
+	}
+	if opts.OwnerGID != nil {
+		gid = *opts.OwnerGID
+	}
+	if o.UID != nil {
+		uid = *o.UID
+	}
+	if o.GID != nil {
+		gid = *o.GID
+	}
+	return uid, gid
+}
+
+// applyOwnership makes sure the pod runs with a group which is able to write on the mounted volumes.
+// Only unset fields of the security context are changed.
+func applyOwnership(pod *corev1.Pod, uid, gid int64, mode string) {
+	if pod.Spec.SecurityContext == nil {
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{}
+		if mode == "" || mode == SecurityContextLegacy {
+			pod.Spec.SecurityContext.RunAsUser = &uid
+		}
+	}
+	sc := pod.Spec.SecurityContext
+
+	switch mode {
+	case SecurityContextMinimal:
+		if sc.FSGroup == nil {
+			sc.FSGroup = &gid
+		}
+	case SecurityContextSupplemental:
+		for _, g := range sc.SupplementalGroups {
+			if g == gid {
+				return
+			}
+		}
+		sc.SupplementalGroups = append(sc.SupplementalGroups, gid)
+	default:
+		if sc.FSGroup == nil {
+			sc.FSGroup = &gid
+		}
+		if sc.RunAsGroup == nil {
+			sc.RunAsGroup = &gid
+		}
+	}
+}
+
+// SetOwnership resolves the owner of the volumes mounted in the pod with the strategy of the options,
+// and sets the pod security context accordingly. What it set is recorded in the InjectedAnnotation, and reverted
+// once the pod has no volumes left. Other pods without volumes are left untouched.
+func (ext *Extension) SetOwnership(ctx context.Context, namespace string, pod *corev1.Pod) error {
+	services, err := ext.resolveServices(ctx, namespace, pod)
+	if err != nil {
+		return err
+	}
+	return ext.setOwnership(ctx, namespace, pod, services)
+}
+
+// setOwnership sets the owner of the volumes of the services given as argument, as SetOwnership does
+func (ext *Extension) setOwnership(ctx context.Context, namespace string, pod *corev1.Pod, services appServices) error {
+	var req *OwnershipRequest
+	for i := range pod.Spec.Containers {
+		if containerServices := services[pod.Spec.Containers[i].Name]; len(containerServices.ServiceMap) > 0 {
+			req = &OwnershipRequest{Client: ext.reader(), Namespace: namespace, Pod: pod, Container: &pod.Spec.Containers[i], Services: containerServices.ServiceMap}
+			break
+		}
+	}
+
+	// What was set for the services declared earlier is reverted, and set again for the ones still declared
+	record, err := readInjected(pod)
+	if err != nil {
+		return err
+	}
+	revertSecurityContext(pod, record.SecurityContext)
+	for _, annotation := range record.Annotations {
+		delete(pod.Annotations, annotation)
+	}
+	record.SecurityContext, record.Annotations = nil, nil
+
+	if req == nil {
+		// The volumes of the init container were removed with the services
+		removeOwnershipInitContainer(pod)
+		return writeInjected(pod, record)
+	}
+
+	resolver, err := ext.Options.ownershipResolver()
+	if err != nil {
+		return err
+	}
+	strategy := ext.Options.OwnershipStrategy
+	if strategy == "" {
+		strategy = OwnershipGuess
+	}
+
+	// NFS shares ignore the fs group, the owner declared by their bindings wins
+	ownership, err := nfsOwnership(ctx, *req)
+	if err != nil {
+		return err
+	}
+	nfs := ownership.UID != nil || ownership.GID != nil
+	if nfs {
+		strategy = "nfs binding"
+	} else if ownership, err = resolver.Resolve(ctx, *req); err != nil {
+		return err
+	}
+	uid, gid := ownership.withDefaults(ext.Options)
+	ext.Logger.Infof("Volumes of POD %s (%s) are owned by uid %d and gid %d (strategy: %s)", pod.Name, namespace, uid, gid, strategy)
+	setAnnotation(pod, OwnershipAnnotation, fmt.Sprintf("%d:%d", uid, gid))
+	record.Annotations = []string{OwnershipAnnotation}
+	before := pod.Spec.SecurityContext.DeepCopy()
+	if ext.Options.SecurityContextMode == SecurityContextInitContainer {
+		ext.setOwnershipInitContainer(pod, req.Container, req.Services, uid, gid)
+	} else {
+		applyOwnership(pod, uid, gid, ext.Options.SecurityContextMode)
+		if err := ext.setFSGroupChangePolicy(pod, req.Services); err != nil {
+			return err
+		}
+	}
+	// The init container changes the owner of the mount points of NFS shares too
+	if nfs && ext.Options.SecurityContextMode != SecurityContextInitContainer {
+		applyNFSOwnership(pod, ownership, ext.Options.SecurityContextMode)
+	}
+	record.SecurityContext = securityContextChanges(before, pod.Spec.SecurityContext)
+	return writeInjected(pod, record)
+}
@@ -0,0 +1,228 @@
+package persistence_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	cfakes "code.cloudfoundry.org/eirini-persi/pkg/controllers/fakes"
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Ownership", func() {
+	var (
+		env    testing.Catalog
+		ctx    context.Context
+		client *cfakes.FakeClient
+		pod    corev1.Pod
+		req    persistence.OwnershipRequest
+	)
+
+	id := func(i int64) *int64 { return &i }
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		client = &cfakes.FakeClient{}
+		pod = env.SimplePersiApp("foo")
+		req = persistence.OwnershipRequest{Client: client, Namespace: "eirini", Pod: &pod, Container: &pod.Spec.Containers[0]}
+	})
+
+	Describe("GuessOwnership", func() {
+		It("resolves nothing without security context", func() {
+			o, err := persistence.GuessOwnership{}.Resolve(ctx, req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(o).To(Equal(persistence.Ownership{}))
+		})
+
+		It("uses the run as user as group if no group is set", func() {
+			pod.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: id(1000)}
+			o, err := persistence.GuessOwnership{}.Resolve(ctx, req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*o.UID).To(Equal(int64(1000)))
+			Expect(*o.GID).To(Equal(int64(1000)))
+		})
+
+		It("uses the run as group", func() {
+			pod.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: id(1000), RunAsGroup: id(1001)}
+			o, err := persistence.GuessOwnership{}.Resolve(ctx, req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*o.GID).To(Equal(int64(1001)))
+		})
+	})
+
+	Describe("FixedOwnership", func() {
+		It("resolves the given ids", func() {
+			o, err := persistence.FixedOwnership{UID: id(1), GID: id(2)}.Resolve(ctx, req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*o.UID).To(Equal(int64(1)))
+			Expect(*o.GID).To(Equal(int64(2)))
+		})
+	})
+
+	Describe("NamespaceAnnotationOwnership", func() {
+		It("reads the namespace annotations", func() {
+			client.GetCalls(func(_ context.Context, nn types.NamespacedName, obj runtime.Object) error {
+				Expect(nn.Name).To(Equal("eirini"))
+				obj.(*corev1.Namespace).Annotations = map[string]string{
+					"eirini-persi.cloudfoundry.org/uid": "1000",
+					"eirini-persi.cloudfoundry.org/gid": "1001",
+				}
+				return nil
+			})
+			o, err := persistence.NamespaceAnnotationOwnership{}.Resolve(ctx, req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*o.UID).To(Equal(int64(1000)))
+			Expect(*o.GID).To(Equal(int64(1001)))
+		})
+
+		It("returns an error if the namespace can't be looked up", func() {
+			client.GetReturns(errors.New("boom"))
+			_, err := persistence.NamespaceAnnotationOwnership{}.Resolve(ctx, req)
+			Expect(err).To(MatchError(ContainSubstring("looking up namespace eirini")))
+		})
+	})
+
+	Describe("PodAnnotationOwnership", func() {
+		It("reads the pod annotations", func() {
+			pod.Annotations = map[string]string{"eirini-persi.cloudfoundry.org/gid": "1001"}
+			o, err := persistence.PodAnnotationOwnership{}.Resolve(ctx, req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(o.UID).To(BeNil())
+			Expect(*o.GID).To(Equal(int64(1001)))
+		})
+
+		It("returns an error on invalid ids", func() {
+			pod.Annotations = map[string]string{"eirini-persi.cloudfoundry.org/uid": "vcap"}
+			_, err := persistence.PodAnnotationOwnership{}.Resolve(ctx, req)
+			Expect(err).To(MatchError(ContainSubstring(`invalid user or group id "vcap"`)))
+		})
+	})
+
+	Describe("BindingOwnership", func() {
+		It("reads the mount_config of the first binding declaring ids", func() {
+			var services persistence.VcapServices
+			Expect(json.Unmarshal([]byte(`{"eirini-persi": [
+				{"credentials": {"volume_id": "a"}, "volume_mounts": [{"container_dir": "/a"}]},
+				{"credentials": {"volume_id": "b"}, "volume_mounts": [{"container_dir": "/b", "mount_config": {"uid": "1000", "gid": 1001}}]}
+			]}`), &services)).To(Succeed())
+			req.Services = services.ServiceMap
+
+			o, err := persistence.BindingOwnership{}.Resolve(ctx, req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*o.UID).To(Equal(int64(1000)))
+			Expect(*o.GID).To(Equal(int64(1001)))
+		})
+	})
+
+	Describe("ContainerOwnership", func() {
+		It("reads the container security context", func() {
+			pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{RunAsUser: id(1000), RunAsGroup: id(1001)}
+			o, err := persistence.ContainerOwnership{}.Resolve(ctx, req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*o.UID).To(Equal(int64(1000)))
+			Expect(*o.GID).To(Equal(int64(1001)))
+		})
+	})
+
+	Describe("SetOwnership", func() {
+		var ext *persistence.Extension
+
+		BeforeEach(func() {
+			ext = &persistence.Extension{Client: client}
+			eirinixcat := eirinixcatalog.NewCatalog()
+			ext.Logger = eirinixcat.SimpleManager().GetLogger()
+		})
+
+		It("sets the security context and annotates the pod", func() {
+			ext.Options = persistence.Options{OwnershipStrategy: persistence.OwnershipFixed, OwnerUID: id(1000), OwnerGID: id(1001)}
+
+			Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+			Expect(*pod.Spec.SecurityContext.RunAsUser).To(Equal(int64(1000)))
+			Expect(*pod.Spec.SecurityContext.RunAsGroup).To(Equal(int64(1001)))
+			Expect(*pod.Spec.SecurityContext.FSGroup).To(Equal(int64(1001)))
+			Expect(pod.Annotations).To(HaveKeyWithValue("eirini-persi.cloudfoundry.org/ownership", "1000:1001"))
+		})
+
+		It("falls back to the default ids", func() {
+			ext.Options = persistence.Options{OwnershipStrategy: persistence.OwnershipContainer}
+
+			Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+			Expect(*pod.Spec.SecurityContext.FSGroup).To(Equal(int64(2000)))
+			Expect(pod.Annotations).To(HaveKeyWithValue("eirini-persi.cloudfoundry.org/ownership", "2000:2000"))
+		})
+
+		It("does not override the existing security context", func() {
+			pod.Spec.SecurityContext = &corev1.PodSecurityContext{FSGroup: id(3000)}
+			ext.Options = persistence.Options{OwnershipStrategy: persistence.OwnershipFixed, OwnerUID: id(1000), OwnerGID: id(1001)}
+
+			Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+			Expect(*pod.Spec.SecurityContext.FSGroup).To(Equal(int64(3000)))
+			Expect(*pod.Spec.SecurityContext.RunAsGroup).To(Equal(int64(1001)))
+			Expect(pod.Spec.SecurityContext.RunAsUser).To(BeNil())
+		})
+
+		Context("in minimal mode", func() {
+			BeforeEach(func() {
+				ext.Options = persistence.Options{SecurityContextMode: persistence.SecurityContextMinimal}
+			})
+
+			It("only sets the fs group", func() {
+				Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+				Expect(*pod.Spec.SecurityContext.FSGroup).To(Equal(int64(2000)))
+				Expect(pod.Spec.SecurityContext.RunAsUser).To(BeNil())
+				Expect(pod.Spec.SecurityContext.RunAsGroup).To(BeNil())
+			})
+
+			It("leaves the run as identity alone", func() {
+				pod.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: id(0)}
+
+				Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+				Expect(*pod.Spec.SecurityContext.RunAsUser).To(Equal(int64(0)))
+				Expect(pod.Spec.SecurityContext.RunAsGroup).To(BeNil())
+				Expect(*pod.Spec.SecurityContext.FSGroup).To(Equal(int64(0)))
+			})
+		})
+
+		Context("in supplemental mode", func() {
+			BeforeEach(func() {
+				ext.Options = persistence.Options{SecurityContextMode: persistence.SecurityContextSupplemental}
+			})
+
+			It("only adds the group to the supplemental groups once", func() {
+				pod.Spec.SecurityContext = &corev1.PodSecurityContext{SupplementalGroups: []int64{10}}
+
+				Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+				Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+				Expect(pod.Spec.SecurityContext.SupplementalGroups).To(Equal([]int64{10, 2000}))
+				Expect(pod.Spec.SecurityContext.FSGroup).To(BeNil())
+				Expect(pod.Spec.SecurityContext.RunAsUser).To(BeNil())
+			})
+		})
+
+		It("does not touch pods without volumes", func() {
+			pod = env.DefaultEiriniAppPod("foo", `{}`)
+
+			Expect(ext.SetOwnership(ctx, "eirini", &pod)).To(Succeed())
+			Expect(pod.Spec.SecurityContext).To(BeNil())
+			Expect(pod.Annotations).To(BeEmpty())
+		})
+	})
+
+	Describe("Options", func() {
+		It("rejects unknown security context modes", func() {
+			Expect(persistence.Options{SecurityContextMode: "root"}.Validate()).To(MatchError(ContainSubstring(`invalid security context mode "root"`)))
+		})
+
+		It("rejects unknown strategies", func() {
+			Expect(persistence.Options{OwnershipStrategy: "random"}.Validate()).To(MatchError(ContainSubstring(`invalid ownership strategy "random"`)))
+		})
+	})
+})
@@ -4,30 +4,106 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"path"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
 
 	eirinix "code.cloudfoundry.org/eirinix"
 	"go.uber.org/zap"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/version"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
+const (
+	// ModeReadWrite is the volume mount mode for writable mounts
+	ModeReadWrite = "rw"
+	// ModeReadOnly is the volume mount mode for read-only mounts
+	ModeReadOnly = "r"
+)
+
+// MountConfig contains optional settings of a volume mount
+type MountConfig struct {
+	// SubPath is a directory inside the volume which is mounted instead of its root
+	SubPath string `json:"sub_path"`
+	// PerInstance mounts a separate directory, named after the pod, for each instance of the app
+	PerInstance bool `json:"per_instance"`
+	// UID is the user owning the volume
+	UID json.Number `json:"uid"`
+	// GID is the group owning the volume
+	GID json.Number `json:"gid"`
+	// FSGroupChangePolicy is the fsGroupChangePolicy of the pod, e.g. OnRootMismatch to avoid changing the
+	// ownership of large volumes on each start
+	FSGroupChangePolicy string `json:"fs_group_change_policy"`
+	// Source is the NFS share of services without volume id, as server:/export or nfs://server/export
+	Source string `json:"source"`
+	// Version is the NFS version of the share
+	Version string `json:"version"`
+	// PerInstanceClaim is the claim created for each instance of the app in StatefulSet mode
+	PerInstanceClaim *PerInstanceClaim `json:"per_instance_claim"`
+}
+
+// PodNameEnv is the environment variable holding the pod name, used to expand per instance sub paths
+const PodNameEnv = "POD_NAME"
+
 // VolumeMount is a volume assigned to the app
 type VolumeMount struct {
-	ContainerDir string `json:"container_dir"`
-	DeviceType   string `json:"device_type"`
-	Mode         string `json:"mode"`
+	ContainerDir string      `json:"container_dir"`
+	DeviceType   string      `json:"device_type"`
+	Mode         string      `json:"mode"`
+	SubPath      string      `json:"sub_path"`
+	MountConfig  MountConfig `json:"mount_config"`
+}
+
+// ReadOnly returns true if the volume has to be mounted read-only, and an error if the mode is unknown
+func (m VolumeMount) ReadOnly() (bool, error) {
+	switch m.Mode {
+	case "", ModeReadWrite:
+		return false, nil
+	case ModeReadOnly:
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid mode %q for container_dir %s: must be %q or %q", m.Mode, m.ContainerDir, ModeReadWrite, ModeReadOnly)
 }
 
 // Credentials is containing the volume id assigned to the pod
 type Credentials struct {
 	// VolumeID represents a Persistent Volume Claim
 	VolumeID string `json:"volume_id"`
+	// Size is the size of the claim, which is created if it doesn't exist
+	Size string `json:"size"`
+	// StorageClass is the storage class of the created claim. The default storage class is used if empty
+	StorageClass string `json:"storage_class"`
+	// MountConfig contains the NFS share of services without volume id, as declared by nfs-volume-release bindings
+	MountConfig MountConfig `json:"mount_config"`
+	// Share is the SMB share of services without volume id, as //server/share
+	Share string `json:"share"`
+	// Username is the user mounting the SMB share
+	Username string `json:"username"`
+	// Password is the password of the user mounting the SMB share
+	Password string `json:"password"`
+	// MountOptions are the comma separated options the SMB share is mounted with, e.g. vers=3.0
+	MountOptions string `json:"mount_options"`
+	// CSI is an inline CSI volume, mounted instead of the claim
+	CSI *CSIConfig `json:"csi"`
+	// Kind is the kind of volume mounted, e.g. VolumeKindScratch. It is guessed from the other credentials,
+	// and from the plan of the service, if empty
+	Kind string `json:"kind"`
+	// SizeLimit is the size of scratch volumes, which is also requested for the container
+	SizeLimit string `json:"size_limit"`
+	// Medium is the storage medium of scratch volumes: Memory for a tmpfs, the node disk if empty
+	Medium string `json:"medium"`
 }
 
 // VcapService contains the service configuration. We look only at volume mounts here
 type VcapService struct {
+	Plan         string        `json:"plan"`
 	Credentials  Credentials   `json:"credentials"`
 	VolumeMounts []VolumeMount `json:"volume_mounts"`
 }
@@ -37,89 +113,526 @@ type VcapServices struct {
 	ServiceMap []VcapService `json:"eirini-persi"`
 }
 
+// DefaultServiceLabel is the VCAP_SERVICES key of the services handled by default
+const DefaultServiceLabel = "eirini-persi"
+
+// Options are the settings of the extension
+type Options struct {
+	// ServiceLabels are the VCAP_SERVICES keys whose services are mounted. Defaults to eirini-persi
+	ServiceLabels []string
+	// AllVolumeServices mounts every service of VCAP_SERVICES which declares volume mounts, regardless of its label
+	AllVolumeServices bool
+	// ClaimValidation is the policy applied when the claims of an app are not suitable for its volume mounts:
+	// ClaimValidationDeny or ClaimValidationWarn. Claims are not validated if empty
+	ClaimValidation string
+	// MountConflictPolicy is the policy applied when a volume mount conflicts with the volumes and mounts of the pod:
+	// MountConflictReject, MountConflictSkip or MountConflictLastWins. Conflicts are not detected if empty
+	MountConflictPolicy string
+	// OwnershipStrategy is the strategy resolving the user and group owning the volumes. Defaults to OwnershipGuess
+	OwnershipStrategy string
+	// OwnerUID is the user owning the volumes with OwnershipFixed, and when a strategy can't resolve it. Defaults to 2000
+	OwnerUID *int64
+	// OwnerGID is the group owning the volumes with OwnershipFixed, and when a strategy can't resolve it. Defaults to 2000
+	OwnerGID *int64
+	// SecurityContextMode defines how the owner of the volumes is set: SecurityContextLegacy, SecurityContextMinimal,
+	// SecurityContextSupplemental or SecurityContextInitContainer. Defaults to SecurityContextLegacy, while the start
+	// command defaults to SecurityContextMinimal
+	SecurityContextMode string
+	// FSGroupChangePolicy is the fsGroupChangePolicy set on pods with an fs group, unless a binding declares one.
+	// It is ignored on clusters older than 1.20
+	FSGroupChangePolicy string
+	// InitImage is the image of the init container changing the ownership of the volumes with
+	// SecurityContextInitContainer. Defaults to DefaultInitImage
+	InitImage string
+	// InitResources are the resources of the init container changing the ownership of the volumes
+	InitResources corev1.ResourceRequirements
+	// InitSecurityContext is the security context of the init container changing the ownership of the volumes
+	InitSecurityContext *corev1.SecurityContext
+	// HostPathVolumes mounts the services of the HostPathPlan as directories of the node, instead of claims.
+	// It is meant for single node development clusters only
+	HostPathVolumes bool
+	// HostPathRoot is the node directory containing the host path volumes. Defaults to DefaultHostPathRoot
+	HostPathRoot string
+	// MountTargetPolicy selects the containers and init containers without VCAP_SERVICES the volumes are also
+	// mounted in: MountTargetAll, MountTargetPattern or MountTargetAnnotation. Only app containers if empty
+	MountTargetPolicy string
+	// MountTargets are the name[=mode] rules of the containers targeted with MountTargetPattern, where name is
+	// a regular expression matching the whole container name and mode is ModeReadOnly (default) or ModeReadWrite
+	MountTargets []string
+	// MountTargetMode is the mode of the volumes mounted in the containers targeted with MountTargetAll. Defaults to ModeReadOnly
+	MountTargetMode string
+	// StatefulSetMode mounts the volumes in the pod template of StatefulSets instead of in pods, which enables
+	// per instance claims. Set by NewStatefulSetMutator
+	StatefulSetMode bool
+}
+
+// Validate returns an error if the options have invalid values
+func (o Options) Validate() error {
+	switch o.ClaimValidation {
+	case "", ClaimValidationDeny, ClaimValidationWarn:
+	default:
+		return fmt.Errorf("invalid claim validation policy %q: must be %q or %q", o.ClaimValidation, ClaimValidationDeny, ClaimValidationWarn)
+	}
+	switch o.MountConflictPolicy {
+	case "", MountConflictReject, MountConflictSkip, MountConflictLastWins:
+	default:
+		return fmt.Errorf("invalid mount conflict policy %q: must be %q, %q or %q", o.MountConflictPolicy, MountConflictReject, MountConflictSkip, MountConflictLastWins)
+	}
+	if _, err := o.ownershipResolver(); err != nil {
+		return err
+	}
+	if err := validateSecurityContextMode(o.SecurityContextMode); err != nil {
+		return err
+	}
+	if err := validateFSGroupChangePolicy(o.FSGroupChangePolicy); err != nil {
+		return err
+	}
+	if err := validateHostPathRoot(o); err != nil {
+		return err
+	}
+	return validateMountTargets(o)
+}
+
+// ParseVcapServices returns the services of the VCAP_SERVICES json given as argument that are selected by the options.
+// Services are returned in the order of the labels in the options, or sorted by label when all services are selected.
+// Only the selected labels are decoded, and services which don't decode are skipped when all services are selected.
+func ParseVcapServices(vcapServices string, opts Options) (VcapServices, error) {
+	services, _, err := parseVcapServices(vcapServices, opts)
+	return services, err
+}
+
+// parseVcapServices is ParseVcapServices, also returning the errors of the services skipped because
+// they don't decode, by label and index
+func parseVcapServices(vcapServices string, opts Options) (VcapServices, map[string]error, error) {
+	var services VcapServices
+	skipped := map[string]error{}
+	var servicesByLabel map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(vcapServices), &servicesByLabel); err != nil {
+		return services, nil, err
+	}
+
+	labels := opts.ServiceLabels
+	if opts.AllVolumeServices {
+		labels = make([]string, 0, len(servicesByLabel))
+		for label := range servicesByLabel {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+	} else if len(labels) == 0 {
+		labels = []string{DefaultServiceLabel}
+	}
+
+	seen := map[string]bool{}
+	for _, label := range labels {
+		raw, ok := servicesByLabel[label]
+		if seen[label] || !ok {
+			continue
+		}
+		seen[label] = true
+
+		var rawServices []json.RawMessage
+		if err := json.Unmarshal(raw, &rawServices); err != nil {
+			if !opts.AllVolumeServices {
+				return services, nil, fmt.Errorf("invalid services of label %s: %w", label, err)
+			}
+			skipped[label] = err
+			continue
+		}
+		for i, rawService := range rawServices {
+			var service VcapService
+			if err := json.Unmarshal(rawService, &service); err != nil {
+				if !opts.AllVolumeServices {
+					return services, nil, fmt.Errorf("invalid service %d of label %s: %w", i, label, err)
+				}
+				skipped[fmt.Sprintf("%s[%d]", label, i)] = err
+				continue
+			}
+			if len(service.VolumeMounts) == 0 {
+				continue
+			}
+			if opts.HostPathVolumes && service.Plan == HostPathPlan && service.Credentials.Kind == "" {
+				service.Credentials.Kind = VolumeKindHostPath
+			}
+			services.ServiceMap = append(services.ServiceMap, service)
+		}
+	}
+	return services, skipped, nil
+}
+
 // Extension changes pod definitions
-type Extension struct{ Logger *zap.SugaredLogger }
+type Extension struct {
+	Logger  *zap.SugaredLogger
+	Options Options
+	// Client is used to create the claims and secrets of the apps. If not set, the client of the Eirini manager is used
+	Client client.Client
+	// Reader is used to look up secrets, claims and namespaces. If not set, the API reader of the Eirini manager
+	// is used, so that lookups don't start informers caching every object of their kind
+	Reader client.Reader
+	// KubeVersion is the version of the API server. If not set, it is looked up once with KubeVersionLookup
+	KubeVersion *version.Info
+	// KubeVersionLookup looks up the version of the API server. If not set, the Eirini manager connection is used
+	KubeVersionLookup func() (*version.Info, error)
+
+	// setup sets up the extension with the Eirini manager on the first request
+	setup sync.Once
+	// kubeVersionOnce resolves kubeVersion once, even if the lookup fails
+	kubeVersionOnce sync.Once
+	kubeVersion     *version.Info
+}
+
+// reader returns the reader of the extension, falling back to its client
+func (ext *Extension) reader() client.Reader {
+	if ext.Reader != nil {
+		return ext.Reader
+	}
+	return ext.Client
+}
 
-func containsContainerMount(containermounts []corev1.VolumeMount, mount string) bool {
+func containsVolume(volumes []corev1.Volume, name string) bool {
+	for _, v := range volumes {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsEnv(env []corev1.EnvVar, name string) bool {
+	for _, e := range env {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// appendPodNameEnv exposes the pod name to the container through the downward API, if not already there.
+// It returns true if the environment variable was added
+func appendPodNameEnv(c *corev1.Container) bool {
+	if containsEnv(c.Env, PodNameEnv) {
+		return false
+	}
+	c.Env = append(c.Env, corev1.EnvVar{
+		Name: PodNameEnv,
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+		},
+	})
+	return true
+}
+
+func containsContainerMount(containermounts []corev1.VolumeMount, mount corev1.VolumeMount) bool {
 	for _, m := range containermounts {
-		if m.Name == mount {
+		if m.Name == mount.Name && m.MountPath == mount.MountPath {
 			return true
 		}
 	}
 	return false
 }
 
-// AppendMounts appends volumes that are specified in VCAP_SERVICES to the pod and to the container given as arguments
-func (s VcapServices) AppendMounts(patchedPod *corev1.Pod, c *corev1.Container) {
+// GetSubPath returns the directory of the volume to mount, or an error if it points outside of the volume.
+// The sub_path of mount_config takes precedence over the top-level one.
+func (m VolumeMount) GetSubPath() (string, error) {
+	subPath := m.SubPath
+	if m.MountConfig.SubPath != "" {
+		subPath = m.MountConfig.SubPath
+	}
+	if subPath == "" {
+		return "", nil
+	}
+
+	if path.IsAbs(subPath) {
+		return "", fmt.Errorf("invalid sub_path %q for container_dir %s: must be a relative path", subPath, m.ContainerDir)
+	}
+	for _, component := range strings.Split(subPath, "/") {
+		if component == ".." {
+			return "", fmt.Errorf("invalid sub_path %q for container_dir %s: must not contain '..'", subPath, m.ContainerDir)
+		}
+	}
+	return subPath, nil
+}
+
+// readOnly returns true if all the volume mounts of the service are read-only
+func (s VcapService) readOnly() (bool, error) {
+	readOnly := len(s.VolumeMounts) > 0
+	for _, volumeMount := range s.VolumeMounts {
+		r, err := volumeMount.ReadOnly()
+		if err != nil {
+			return false, err
+		}
+		readOnly = readOnly && r
+	}
+	return readOnly, nil
+}
+
+const (
+	// VolumeKindClaim mounts the claim named after the volume id
+	VolumeKindClaim = "claim"
+	// VolumeKindCSI mounts the inline CSI volume declared by the credentials
+	VolumeKindCSI = "csi"
+	// VolumeKindNFS mounts the NFS share declared by the mount_config of the credentials
+	VolumeKindNFS = "nfs"
+	// VolumeKindSMB mounts the SMB share declared by the credentials
+	VolumeKindSMB = "smb"
+	// VolumeKindScratch mounts an empty dir, which survives container restarts but not rescheduling
+	VolumeKindScratch = "scratch"
+)
+
+// volumeKinds are the valid volume kinds
+var volumeKinds = []string{VolumeKindClaim, VolumeKindCSI, VolumeKindNFS, VolumeKindSMB, VolumeKindScratch, VolumeKindHostPath, VolumeKindInstanceClaim}
+
+// kind returns the kind of the volume of the service. Unless the credentials declare it, it is an inline CSI volume
+// or a per instance claim if they declare one, a claim if they have a volume id, an NFS or SMB share otherwise
+func (s VcapService) kind() string {
+	switch {
+	case s.Credentials.Kind != "":
+		return s.Credentials.Kind
+	case s.Credentials.CSI != nil:
+		return VolumeKindCSI
+	case s.Credentials.MountConfig.PerInstanceClaim != nil:
+		return VolumeKindInstanceClaim
+	case s.Credentials.VolumeID != "":
+		return VolumeKindClaim
+	case s.Credentials.MountConfig.Source != "":
+		return VolumeKindNFS
+	case s.Credentials.Share != "":
+		return VolumeKindSMB
+	}
+	return VolumeKindClaim
+}
+
+// isClaim returns true if the volume of the service is the claim named after its volume id
+func (s VcapService) isClaim() bool {
+	return s.kind() == VolumeKindClaim
+}
+
+// volumeID returns the id the volume of the service is named after: its claim, its inline CSI volume,
+// its NFS or SMB share, or its scratch space
+func (s VcapService) volumeID() string {
+	switch s.kind() {
+	case VolumeKindCSI:
+		return s.csiVolumeID()
+	case VolumeKindNFS:
+		return s.Credentials.MountConfig.Source
+	case VolumeKindSMB:
+		return s.Credentials.Share
+	case VolumeKindScratch:
+		return s.scratchVolumeID()
+	}
+	return s.Credentials.VolumeID
+}
+
+// volumeSource returns the source of the volume of the service, according to its kind
+func (s VcapService) volumeSource(readOnly bool, opts Options) (corev1.VolumeSource, error) {
+	switch s.kind() {
+	case VolumeKindClaim:
+		return corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: s.Credentials.VolumeID,
+				ReadOnly:  readOnly,
+			},
+		}, nil
+	case VolumeKindCSI:
+		return s.csiVolumeSource(readOnly)
+	case VolumeKindNFS:
+		return s.nfsVolumeSource(readOnly)
+	case VolumeKindSMB:
+		return s.smbVolumeSource(readOnly), nil
+	case VolumeKindScratch:
+		return s.scratchVolumeSource()
+	case VolumeKindHostPath:
+		return s.hostPathVolumeSource(opts)
+	case VolumeKindInstanceClaim:
+		return s.instanceClaimVolumeSource(readOnly, opts)
+	}
+	return corev1.VolumeSource{}, fmt.Errorf("invalid volume kind %q for volume %s: must be one of %s", s.Credentials.Kind,
+		s.Credentials.VolumeID, strings.Join(volumeKinds, ", "))
+}
+
+// AppendMounts appends volumes that are specified in VCAP_SERVICES to the pod and to the container given as arguments.
+// Each claim is added once as a pod volume, and mounted in the container in every container_dir declared
+// by the service, in the order they appear in VCAP_SERVICES. Conflicts with the volumes and mounts already
+// in the pod are resolved according to the MountConflictPolicy of the options.
+func (s VcapServices) AppendMounts(patchedPod *corev1.Pod, c *corev1.Container, opts Options) error {
+	return s.appendMounts(patchedPod, c, opts, false)
+}
+
+// appendMounts implements AppendMounts. The volumes are mounted read-only in the container if forceReadOnly is true,
+// leaving the pod volumes, which may be shared with other containers, as declared.
+func (s VcapServices) appendMounts(patchedPod *corev1.Pod, c *corev1.Container, opts Options, forceReadOnly bool) error {
 	for _, volumeService := range s.ServiceMap {
+		claimReadOnly, err := volumeService.readOnly()
+		if err != nil {
+			return err
+		}
+
+		source, err := volumeService.volumeSource(claimReadOnly, opts)
+		if err != nil {
+			return err
+		}
+		volume := corev1.Volume{
+			Name:         VolumeName(volumeService.volumeID()),
+			VolumeSource: source,
+		}
 		for _, volumeMount := range volumeService.VolumeMounts {
-			if !containsContainerMount(c.VolumeMounts, volumeService.Credentials.VolumeID) {
-				patchedPod.Spec.Volumes = append(patchedPod.Spec.Volumes, corev1.Volume{
-					Name: volumeService.Credentials.VolumeID,
-					VolumeSource: corev1.VolumeSource{
-						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-							ClaimName: volumeService.Credentials.VolumeID,
-						},
-					},
-				})
-
-				c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
-					Name:      volumeService.Credentials.VolumeID,
-					MountPath: volumeMount.ContainerDir,
-				})
-
-				vcap := int64(2000) // Best guess for vcap group id
-				if patchedPod.Spec.SecurityContext == nil {
-					patchedPod.Spec.SecurityContext = &corev1.PodSecurityContext{
-						RunAsUser:  &vcap,
-						RunAsGroup: &vcap,
-						FSGroup:    &vcap,
-					}
-				} else {
-					// Try to find a better guess for the group id
-					if patchedPod.Spec.SecurityContext.RunAsGroup != nil {
-						vcap = *patchedPod.Spec.SecurityContext.RunAsGroup
-					} else if patchedPod.Spec.SecurityContext.RunAsUser != nil {
-						// Normally uid == gid for vcap user
-						vcap = *patchedPod.Spec.SecurityContext.RunAsUser
-					}
-					if patchedPod.Spec.SecurityContext.FSGroup == nil {
-						patchedPod.Spec.SecurityContext.FSGroup = &vcap
+			readOnly, err := volumeMount.ReadOnly()
+			if err != nil {
+				return err
+			}
+			subPath, err := volumeMount.GetSubPath()
+			if err != nil {
+				return err
+			}
+
+			mount := corev1.VolumeMount{
+				Name:      volume.Name,
+				MountPath: volumeMount.ContainerDir,
+				ReadOnly:  readOnly || forceReadOnly,
+				SubPath:   subPath,
+			}
+			if volumeMount.MountConfig.PerInstance {
+				// SubPath and SubPathExpr are mutually exclusive
+				mount.SubPath = ""
+				mount.SubPathExpr = path.Join(subPath, "$("+PodNameEnv+")")
+			}
+			if containsContainerMount(c.VolumeMounts, mount) {
+				// The mount was added by an earlier invocation of the webhook, or by another extension:
+				// the pod is left as is, provided the volume it mounts exists
+				if !containsVolume(patchedPod.Spec.Volumes, volume.Name) {
+					patchedPod.Spec.Volumes = append(patchedPod.Spec.Volumes, volume)
+				}
+				continue
+			}
+
+			skip, err := resolveConflicts(patchedPod, c, volume, mount, opts.MountConflictPolicy)
+			if err != nil {
+				return err
+			}
+			if skip {
+				continue
+			}
+
+			if err := recordVolumeID(patchedPod, volume.Name, volumeService.volumeID()); err != nil {
+				return err
+			}
+			if !containsVolume(patchedPod.Spec.Volumes, volume.Name) {
+				patchedPod.Spec.Volumes = append(patchedPod.Spec.Volumes, volume)
+				if volumeService.kind() == VolumeKindScratch {
+					added, err := volumeService.requestScratchSpace(c)
+					if err != nil {
+						return err
 					}
-					if patchedPod.Spec.SecurityContext.RunAsGroup == nil {
-						patchedPod.Spec.SecurityContext.RunAsGroup = &vcap
+					if err := recordInjectedResources(patchedPod, volume.Name, c.Name, added); err != nil {
+						return err
 					}
 				}
 			}
+
+			if mount.SubPathExpr != "" && appendPodNameEnv(c) {
+				if err := recordInjectedEnv(patchedPod, c.Name, PodNameEnv); err != nil {
+					return err
+				}
+			}
+			c.VolumeMounts = append(c.VolumeMounts, mount)
+		}
+	}
+	return nil
+}
+
+// containerServices returns the services declared in the VCAP_SERVICES environment variable of the container,
+// which can be read from a secret of the namespace given as argument. The boolean is false if the container has no VCAP_SERVICES.
+func (ext *Extension) containerServices(ctx context.Context, namespace string, c *corev1.Container) (VcapServices, bool, error) {
+	for _, env := range c.Env {
+		if env.Name != VcapServicesEnv {
+			continue
+		}
+		value, found, err := ext.vcapServicesValue(ctx, namespace, env)
+		if err != nil || !found {
+			return VcapServices{}, false, err
+		}
+		services, skipped, err := parseVcapServices(value, ext.Options)
+		for service, err := range skipped {
+			ext.Logger.Infof("Skipping service %s of container %s, which doesn't decode: %s", service, c.Name, err.Error())
 		}
+		return services, true, err
+	}
+	return VcapServices{}, false, nil
+}
+
+// appServices are the services declared in the VCAP_SERVICES of the containers of a pod, by container name.
+// Containers without VCAP_SERVICES have no entry
+type appServices map[string]VcapServices
+
+// resolveServices returns the services of the containers of the pod, which can be read from secrets of the namespace
+// given as argument. They are resolved once per admission, so that every step sees the same VCAP_SERVICES
+func (ext *Extension) resolveServices(ctx context.Context, namespace string, pod *corev1.Pod) (appServices, error) {
+	services := appServices{}
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		containerServices, found, err := ext.containerServices(ctx, namespace, c)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			services[c.Name] = containerServices
+		}
+	}
+	return services, nil
+}
+
+// all returns the services of all the containers of the pod, in the order of its containers
+func (s appServices) all(pod *corev1.Pod) []VcapService {
+	var services []VcapService
+	for _, c := range pod.Spec.Containers {
+		services = append(services, s[c.Name].ServiceMap...)
+	}
+	return services
+}
+
+// MountVcapVolumes alters the pod given as argument with the required volumes mounted.
+// The namespace is the one of the secrets VCAP_SERVICES can be read from. The volumes of the containers declaring
+// VCAP_SERVICES are then mounted in the other containers targeted by the MountTargetPolicy of the options.
+func (ext *Extension) MountVcapVolumes(ctx context.Context, namespace string, patchedPod *corev1.Pod) error {
+	services, err := ext.resolveServices(ctx, namespace, patchedPod)
+	if err != nil {
+		return err
 	}
+	return ext.mountServices(patchedPod, services)
 }
 
-// MountVcapVolumes alters the pod given as argument with the required volumes mounted
-func (ext *Extension) MountVcapVolumes(patchedPod *corev1.Pod) error {
+// mountServices mounts the volumes of the services given as argument, as MountVcapVolumes does
+func (ext *Extension) mountServices(patchedPod *corev1.Pod, appServices appServices) error {
+	var podServices VcapServices
+	apps := map[string]bool{}
 	for i := range patchedPod.Spec.Containers {
 		c := &patchedPod.Spec.Containers[i]
-		for _, env := range c.Env {
-			if env.Name != "VCAP_SERVICES" {
-				continue
-			}
-			ext.Logger.Debug("Appending volumes to the Eirini App")
+		services, found := appServices[c.Name]
+		if !found {
+			continue
+		}
+		ext.Logger.Debug("Appending volumes to the Eirini App")
 
-			var services VcapServices
-			err := json.Unmarshal([]byte(env.Value), &services)
-			if err != nil {
-				return err
-			}
-			services.AppendMounts(patchedPod, c)
-			break
+		if err := services.AppendMounts(patchedPod, c, ext.Options); err != nil {
+			return err
 		}
+		apps[c.Name] = true
+		podServices.ServiceMap = append(podServices.ServiceMap, services.ServiceMap...)
 	}
-	return nil
+
+	if len(podServices.ServiceMap) == 0 {
+		return nil
+	}
+	return ext.mountTargets(patchedPod, podServices, apps)
 }
 
 // New returns the persi extension
 func New() eirinix.Extension {
-	return &Extension{}
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions returns the persi extension configured with the given options
+func NewWithOptions(opts Options) eirinix.Extension {
+	return &Extension{Options: opts}
 }
 
 // Handle manages volume claims for ExtendedStatefulSet pods
@@ -128,18 +641,88 @@ func (ext *Extension) Handle(ctx context.Context, eiriniManager eirinix.Manager,
 	if pod == nil {
 		return admission.Errored(http.StatusBadRequest, errors.New("No pod could be decoded from the request"))
 	}
+	if req.Operation == admissionv1beta1.Update {
+		// The spec of existing pods can't be changed, their volumes were mounted when they were created
+		return admission.Allowed("")
+	}
 
-	_, file, _, _ := runtime.Caller(0)
-	log := eiriniManager.GetLogger().Named(file)
+	// Requests are handled concurrently, the extension is only changed once
+	ext.setup.Do(func() {
+		_, file, _, _ := runtime.Caller(0)
+		ext.Logger = eiriniManager.GetLogger().Named(file)
+		if kubeManager := eiriniManager.GetKubeManager(); kubeManager != nil {
+			if ext.Client == nil {
+				ext.Client = kubeManager.GetClient()
+			}
+			if ext.Reader == nil {
+				ext.Reader = kubeManager.GetAPIReader()
+			}
+		}
+		if ext.KubeVersionLookup == nil {
+			ext.KubeVersionLookup = kubeVersionLookup(eiriniManager)
+		}
+	})
 
-	ext.Logger = log
 	podCopy := pod.DeepCopy()
-	log.Debugf("Handling webhook request for POD: %s (%s)", podCopy.Name, podCopy.Namespace)
+	ext.Logger.Debugf("Handling webhook request for POD: %s (%s)", podCopy.Name, podCopy.Namespace)
+
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = podCopy.Namespace
+	}
 
-	err := ext.MountVcapVolumes(podCopy)
+	services, err := ext.resolveServices(ctx, namespace, podCopy)
 	if err != nil {
 		return admission.Errored(http.StatusBadRequest, err)
 	}
+	if resp := ext.mutatePod(ctx, namespace, podCopy, services); !resp.Allowed {
+		return resp
+	}
 
 	return eiriniManager.PatchFromPod(req, podCopy)
 }
+
+// mutatePod mounts the volumes of the services of the pod given as argument, and provisions what they need.
+// The returned response is allowed if the pod can be admitted
+func (ext *Extension) mutatePod(ctx context.Context, namespace string, pod *corev1.Pod, services appServices) admission.Response {
+	if err := ext.syncVolumes(namespace, pod, services); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if err := ext.setOwnership(ctx, namespace, pod, services); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	// Claims are validated as they will be provisioned, so that nothing is created for pods which are denied
+	podServices := services.all(pod)
+	claims, missing, err := ext.planClaims(ctx, namespace, pod, podServices)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	if ext.Options.ClaimValidation != "" {
+		problems, err := ext.validateClaims(ctx, namespace, podServices, claims)
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		if len(problems) > 0 {
+			if ext.Options.ClaimValidation == ClaimValidationDeny {
+				return admission.Denied(strings.Join(problems, "; "))
+			}
+			ext.Logger.Warnf("Admitting POD %s (%s) with volume problems: %s", pod.Name, namespace, strings.Join(problems, "; "))
+			for _, problem := range problems {
+				addWarning(pod, problem)
+			}
+		}
+	}
+
+	if err := ext.createClaims(ctx, namespace, missing); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	if err := ext.provisionSMBSecrets(ctx, namespace, podServices); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	return admission.Allowed("")
+}
@@ -13,6 +13,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 
@@ -86,7 +87,9 @@ var _ = Describe("Persistence Extension", func() {
 			raw, _ := json.Marshal(&pod)
 			request.Object.Raw = raw
 			resp := eiriniExt.Handle(ctx, eiriniManager, &pod, request)
-			Expect(len(resp.Patches)).To(Equal(3))
+			Expect(len(resp.Patches)).To(Equal(4))
+			Expect(decodePatches(resp)).To(ContainSubstring(`{"op":"add","path":"/spec/securityContext","value":{"fsGroup":2000,"runAsGroup":2000,"runAsUser":2000}}`))
+			Expect(decodePatches(resp)).To(ContainSubstring(`{"op":"add","path":"/metadata/annotations","value":{"eirini-persi.cloudfoundry.org/injected":"{\"volumes\":[\"the-volume-id\"],\"mounts\":{\"busybox\":[\"the-volume-id:/var/vcap/data/de847d34-bdcc-4c5d-92b1-cf2158a15b47\"]},\"securityContext\":{\"runAsUser\":2000,\"runAsGroup\":2000,\"fsGroup\":2000},\"annotations\":[\"eirini-persi.cloudfoundry.org/ownership\"]}","eirini-persi.cloudfoundry.org/ownership":"2000:2000"}}`))
 		})
 
 		It("does act if the source_type: APP label is set and 3 volumes are supplied", func() {
@@ -94,14 +97,24 @@ var _ = Describe("Persistence Extension", func() {
 			raw, _ := json.Marshal(&pod)
 			request.Object.Raw = raw
 			resp := eiriniExt.Handle(ctx, eiriniManager, &pod, request)
-			Expect(len(resp.Patches)).To(Equal(3))
+			Expect(len(resp.Patches)).To(Equal(4))
 
 			ops := env.MultipleVolumePersiAppOps()
-			Expect(len(resp.Patches)).To(Equal(len(ops) + 1))
+			Expect(len(resp.Patches)).To(Equal(len(ops) + 2))
 			for _, op := range ops {
 				Expect(decodePatches(resp)).Should(ContainSubstring(op))
 			}
 		})
+
+		It("denies the request if a volume mount has an invalid mode", func() {
+			pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": { "volume_id": "the-volume-id" }, "volume_mounts": [{"container_dir": "/data", "mode": "x"}]}]}`)
+			raw, _ := json.Marshal(&pod)
+			request.Object.Raw = raw
+			resp := eiriniExt.Handle(ctx, eiriniManager, &pod, request)
+			Expect(resp.AdmissionResponse.Allowed).To(BeFalse())
+			Expect(resp.AdmissionResponse.Result.Code).To(Equal(int32(http.StatusBadRequest)))
+			Expect(resp.AdmissionResponse.Result.Message).To(ContainSubstring(`invalid mode "x"`))
+		})
 	})
 
 	Describe("AppendMounts", func() {
@@ -112,7 +125,7 @@ var _ = Describe("Persistence Extension", func() {
 				Credentials:  persistence.Credentials{VolumeID: "foo"},
 				VolumeMounts: []persistence.VolumeMount{persistence.VolumeMount{ContainerDir: "/foo/"}},
 			})
-			services.AppendMounts(&pod, &pod.Spec.Containers[0])
+			services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})
 
 			Expect(pod.Spec.Containers[0].VolumeMounts[0].Name).To(Equal("foo"))
 			Expect(pod.Spec.Containers[0].VolumeMounts[0].MountPath).To(Equal("/foo/"))
@@ -130,13 +143,229 @@ var _ = Describe("Persistence Extension", func() {
 
 			Expect(len(pod.Spec.Containers[0].VolumeMounts)).To(Equal(0))
 			Expect(len(pod.Spec.Volumes)).To(Equal(0))
-			services.AppendMounts(&pod, &pod.Spec.Containers[0])
+			services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})
 			Expect(len(pod.Spec.Volumes)).To(Equal(1))
 			Expect(len(pod.Spec.Containers[0].VolumeMounts)).To(Equal(1))
-			services.AppendMounts(&pod, &pod.Spec.Containers[0])
+			services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})
 			Expect(len(pod.Spec.Containers[0].VolumeMounts)).To(Equal(1))
 			Expect(len(pod.Spec.Volumes)).To(Equal(1))
 		})
+
+		It("is idempotent when a service declares several container_dirs", func() {
+			var services persistence.VcapServices
+			pod := env.DefaultEiriniAppPod("bar", ``)
+			services.ServiceMap = append(services.ServiceMap, persistence.VcapService{
+				Credentials: persistence.Credentials{VolumeID: "foo"},
+				VolumeMounts: []persistence.VolumeMount{
+					persistence.VolumeMount{ContainerDir: "/foo/"},
+					persistence.VolumeMount{ContainerDir: "/bar/"},
+				},
+			})
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})).To(Succeed())
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})).To(Succeed())
+			Expect(len(pod.Spec.Volumes)).To(Equal(1))
+			Expect(len(pod.Spec.Containers[0].VolumeMounts)).To(Equal(2))
+			Expect(pod.Spec.Containers[0].VolumeMounts[0].MountPath).To(Equal("/foo/"))
+			Expect(pod.Spec.Containers[0].VolumeMounts[1].MountPath).To(Equal("/bar/"))
+		})
+
+		It("mounts volumes read-only if the mode is r", func() {
+			var services persistence.VcapServices
+			pod := env.DefaultEiriniAppPod("bar", ``)
+			services.ServiceMap = append(services.ServiceMap, persistence.VcapService{
+				Credentials:  persistence.Credentials{VolumeID: "foo"},
+				VolumeMounts: []persistence.VolumeMount{persistence.VolumeMount{ContainerDir: "/foo/", Mode: "r"}},
+			})
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})).To(Succeed())
+			Expect(pod.Spec.Containers[0].VolumeMounts[0].ReadOnly).To(BeTrue())
+			Expect(pod.Spec.Volumes[0].VolumeSource.PersistentVolumeClaim.ReadOnly).To(BeTrue())
+		})
+
+		It("mounts volumes writable if the mode is rw", func() {
+			var services persistence.VcapServices
+			pod := env.DefaultEiriniAppPod("bar", ``)
+			services.ServiceMap = append(services.ServiceMap, persistence.VcapService{
+				Credentials:  persistence.Credentials{VolumeID: "foo"},
+				VolumeMounts: []persistence.VolumeMount{persistence.VolumeMount{ContainerDir: "/foo/", Mode: "rw"}},
+			})
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})).To(Succeed())
+			Expect(pod.Spec.Containers[0].VolumeMounts[0].ReadOnly).To(BeFalse())
+			Expect(pod.Spec.Volumes[0].VolumeSource.PersistentVolumeClaim.ReadOnly).To(BeFalse())
+		})
+
+		It("mounts a sub directory of the volume if sub_path is set", func() {
+			var services persistence.VcapServices
+			pod := env.DefaultEiriniAppPod("bar", ``)
+			services.ServiceMap = append(services.ServiceMap, persistence.VcapService{
+				Credentials: persistence.Credentials{VolumeID: "foo"},
+				VolumeMounts: []persistence.VolumeMount{
+					persistence.VolumeMount{ContainerDir: "/foo/", SubPath: "apps/foo"},
+					persistence.VolumeMount{ContainerDir: "/bar/", MountConfig: persistence.MountConfig{SubPath: "apps/bar"}},
+				},
+			})
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})).To(Succeed())
+			Expect(pod.Spec.Containers[0].VolumeMounts[0].SubPath).To(Equal("apps/foo"))
+			Expect(pod.Spec.Containers[0].VolumeMounts[1].SubPath).To(Equal("apps/bar"))
+		})
+
+		It("parses sub_path from mount_config", func() {
+			var services persistence.VcapServices
+			Expect(json.Unmarshal([]byte(`{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo", "mount_config": {"sub_path": "my-app"}}]}]}`), &services)).To(Succeed())
+			pod := env.DefaultEiriniAppPod("bar", ``)
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})).To(Succeed())
+			Expect(pod.Spec.Containers[0].VolumeMounts[0].SubPath).To(Equal("my-app"))
+		})
+
+		It("mounts a directory per instance if per_instance is set", func() {
+			var services persistence.VcapServices
+			pod := env.DefaultEiriniAppPod("bar", ``)
+			services.ServiceMap = append(services.ServiceMap, persistence.VcapService{
+				Credentials: persistence.Credentials{VolumeID: "foo"},
+				VolumeMounts: []persistence.VolumeMount{
+					persistence.VolumeMount{ContainerDir: "/foo/", MountConfig: persistence.MountConfig{PerInstance: true}},
+					persistence.VolumeMount{ContainerDir: "/bar/", MountConfig: persistence.MountConfig{PerInstance: true, SubPath: "apps/bar"}},
+				},
+			})
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})).To(Succeed())
+			c := pod.Spec.Containers[0]
+			Expect(c.VolumeMounts[0].SubPath).To(BeEmpty())
+			Expect(c.VolumeMounts[0].SubPathExpr).To(Equal("$(POD_NAME)"))
+			Expect(c.VolumeMounts[1].SubPath).To(BeEmpty())
+			Expect(c.VolumeMounts[1].SubPathExpr).To(Equal("apps/bar/$(POD_NAME)"))
+
+			Expect(len(c.Env)).To(Equal(2))
+			Expect(c.Env[1].Name).To(Equal("POD_NAME"))
+			Expect(c.Env[1].ValueFrom.FieldRef.FieldPath).To(Equal("metadata.name"))
+		})
+
+		It("does not override an existing POD_NAME environment variable", func() {
+			var services persistence.VcapServices
+			pod := env.DefaultEiriniAppPod("bar", ``)
+			pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "POD_NAME", Value: "bar"})
+			services.ServiceMap = append(services.ServiceMap, persistence.VcapService{
+				Credentials:  persistence.Credentials{VolumeID: "foo"},
+				VolumeMounts: []persistence.VolumeMount{persistence.VolumeMount{ContainerDir: "/foo/", MountConfig: persistence.MountConfig{PerInstance: true}}},
+			})
+
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})).To(Succeed())
+			Expect(services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})).To(Succeed())
+			Expect(len(pod.Spec.Containers[0].Env)).To(Equal(2))
+			Expect(pod.Spec.Containers[0].Env[1].Value).To(Equal("bar"))
+			Expect(len(pod.Spec.Containers[0].VolumeMounts)).To(Equal(1))
+		})
+
+		It("returns an error if sub_path is absolute", func() {
+			var services persistence.VcapServices
+			pod := env.DefaultEiriniAppPod("bar", ``)
+			services.ServiceMap = append(services.ServiceMap, persistence.VcapService{
+				Credentials:  persistence.Credentials{VolumeID: "foo"},
+				VolumeMounts: []persistence.VolumeMount{persistence.VolumeMount{ContainerDir: "/foo/", SubPath: "/etc"}},
+			})
+
+			err := services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("must be a relative path"))
+		})
+
+		It("returns an error if sub_path escapes the volume", func() {
+			var services persistence.VcapServices
+			pod := env.DefaultEiriniAppPod("bar", ``)
+			services.ServiceMap = append(services.ServiceMap, persistence.VcapService{
+				Credentials:  persistence.Credentials{VolumeID: "foo"},
+				VolumeMounts: []persistence.VolumeMount{persistence.VolumeMount{ContainerDir: "/foo/", MountConfig: persistence.MountConfig{SubPath: "apps/../../other"}}},
+			})
+
+			err := services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("must not contain '..'"))
+		})
+
+		It("returns an error if the mode is unknown", func() {
+			var services persistence.VcapServices
+			pod := env.DefaultEiriniAppPod("bar", ``)
+			services.ServiceMap = append(services.ServiceMap, persistence.VcapService{
+				Credentials:  persistence.Credentials{VolumeID: "foo"},
+				VolumeMounts: []persistence.VolumeMount{persistence.VolumeMount{ContainerDir: "/foo/", Mode: "rwx"}},
+			})
+
+			err := services.AppendMounts(&pod, &pod.Spec.Containers[0], persistence.Options{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`invalid mode "rwx"`))
+			Expect(len(pod.Spec.Volumes)).To(Equal(0))
+		})
+	})
+
+	Describe("ParseVcapServices", func() {
+		vcap := `{
+			"nfs": [{"credentials": {"volume_id": "nfs-volume"}, "volume_mounts": [{"container_dir": "/nfs"}]}],
+			"eirini-persi": [{"credentials": {"volume_id": "persi-volume"}, "volume_mounts": [{"container_dir": "/persi"}]}],
+			"smb": [{"credentials": {"volume_id": "smb-volume"}, "volume_mounts": [{"container_dir": "/smb"}]}],
+			"mysql": [{"credentials": {"uri": "mysql://"}}]
+		}`
+
+		It("selects the eirini-persi services by default", func() {
+			services, err := persistence.ParseVcapServices(vcap, persistence.Options{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(services.ServiceMap)).To(Equal(1))
+			Expect(services.ServiceMap[0].Credentials.VolumeID).To(Equal("persi-volume"))
+		})
+
+		It("selects the services with the given labels in order", func() {
+			services, err := persistence.ParseVcapServices(vcap, persistence.Options{ServiceLabels: []string{"smb", "nfs", "smb"}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(services.ServiceMap)).To(Equal(2))
+			Expect(services.ServiceMap[0].Credentials.VolumeID).To(Equal("smb-volume"))
+			Expect(services.ServiceMap[1].Credentials.VolumeID).To(Equal("nfs-volume"))
+		})
+
+		It("selects every service declaring volume mounts", func() {
+			services, err := persistence.ParseVcapServices(vcap, persistence.Options{AllVolumeServices: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(services.ServiceMap)).To(Equal(3))
+			Expect(services.ServiceMap[0].Credentials.VolumeID).To(Equal("persi-volume"))
+			Expect(services.ServiceMap[1].Credentials.VolumeID).To(Equal("nfs-volume"))
+			Expect(services.ServiceMap[2].Credentials.VolumeID).To(Equal("smb-volume"))
+		})
+
+		It("ignores the services of other labels whose credentials don't decode", func() {
+			services, err := persistence.ParseVcapServices(`{
+				"p-mysql": [{"credentials": {"size": 10}}],
+				"user-provided": [{"credentials": {"csi": "yes"}}],
+				"eirini-persi": [{"credentials": {"volume_id": "persi-volume"}, "volume_mounts": [{"container_dir": "/persi"}]}]
+			}`, persistence.Options{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(services.ServiceMap)).To(Equal(1))
+			Expect(services.ServiceMap[0].Credentials.VolumeID).To(Equal("persi-volume"))
+		})
+
+		It("skips the services which don't decode when every service is selected", func() {
+			services, err := persistence.ParseVcapServices(`{
+				"p-mysql": [{"credentials": {"size": 10}}],
+				"user-provided": [{"credentials": {"csi": "yes"}, "volume_mounts": [{"container_dir": "/up"}]}, {"credentials": {"volume_id": "up-volume"}, "volume_mounts": [{"container_dir": "/up"}]}],
+				"broken": {"credentials": {}},
+				"eirini-persi": [{"credentials": {"volume_id": "persi-volume"}, "volume_mounts": [{"container_dir": "/persi"}]}]
+			}`, persistence.Options{AllVolumeServices: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(services.ServiceMap)).To(Equal(2))
+			Expect(services.ServiceMap[0].Credentials.VolumeID).To(Equal("persi-volume"))
+			Expect(services.ServiceMap[1].Credentials.VolumeID).To(Equal("up-volume"))
+		})
+
+		It("returns an error if the services of a selected label don't decode", func() {
+			_, err := persistence.ParseVcapServices(`{"eirini-persi": [{"credentials": {"volume_id": 1}}]}`, persistence.Options{})
+			Expect(err).To(MatchError(ContainSubstring("invalid service 0 of label eirini-persi")))
+		})
+
+		It("returns an error if VCAP_SERVICES is not a json", func() {
+			_, err := persistence.ParseVcapServices(`{`, persistence.Options{})
+			Expect(err).To(HaveOccurred())
+		})
 	})
 
 	Describe("MountVcapVolumes", func() {
@@ -146,7 +375,7 @@ var _ = Describe("Persistence Extension", func() {
 			Expect(ok).To(BeTrue())
 			ext.Logger = eiriniManager.GetLogger()
 
-			err := ext.MountVcapVolumes(&pod)
+			err := ext.MountVcapVolumes(ctx, "eirini", &pod)
 
 			Expect(err).ToNot(HaveOccurred())
 			Expect(pod.Spec.Containers[0].VolumeMounts[0].Name).To(Equal("the-volume-id1"))
@@ -161,18 +390,45 @@ var _ = Describe("Persistence Extension", func() {
 			Expect(ok).To(BeTrue())
 			ext.Logger = eiriniManager.GetLogger()
 
-			err := ext.MountVcapVolumes(&pod)
+			err := ext.MountVcapVolumes(ctx, "eirini", &pod)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(len(pod.Spec.Containers[0].VolumeMounts)).To(Equal(0))
 			Expect(len(pod.Spec.Volumes)).To(Equal(0))
 		})
 
+		It("mounts every container_dir of a service using a single volume", func() {
+			pod := env.MultipleMountsPersiApp("foo")
+			ext, ok := eiriniExt.(*persistence.Extension)
+			Expect(ok).To(BeTrue())
+			ext.Logger = eiriniManager.GetLogger()
+
+			Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+			Expect(len(pod.Spec.Volumes)).To(Equal(1))
+			Expect(pod.Spec.Volumes[0].Name).To(Equal("the-volume-id"))
+			Expect(len(pod.Spec.Containers[0].VolumeMounts)).To(Equal(2))
+			Expect(pod.Spec.Containers[0].VolumeMounts[0].Name).To(Equal("the-volume-id"))
+			Expect(pod.Spec.Containers[0].VolumeMounts[0].MountPath).To(Equal("/var/vcap/data/data"))
+			Expect(pod.Spec.Containers[0].VolumeMounts[1].Name).To(Equal("the-volume-id"))
+			Expect(pod.Spec.Containers[0].VolumeMounts[1].MountPath).To(Equal("/var/vcap/data/logs"))
+		})
+
+		It("mounts services with the configured labels", func() {
+			pod := env.DefaultEiriniAppPod("foo", `{"nfs": [{"credentials": {"volume_id": "nfs-volume"}, "volume_mounts": [{"container_dir": "/nfs"}]}]}`)
+			ext, ok := persistence.NewWithOptions(persistence.Options{ServiceLabels: []string{"nfs"}}).(*persistence.Extension)
+			Expect(ok).To(BeTrue())
+			ext.Logger = eiriniManager.GetLogger()
+
+			Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+			Expect(len(pod.Spec.Volumes)).To(Equal(1))
+			Expect(pod.Spec.Volumes[0].Name).To(Equal("nfs-volume"))
+		})
+
 		It("returns an error if VCAP_SERVICES is not a json", func() {
 			pod := env.DefaultEiriniAppPod("foo", ``)
 			ext, ok := eiriniExt.(*persistence.Extension)
 			Expect(ok).To(BeTrue())
 			ext.Logger = eiriniManager.GetLogger()
-			err := ext.MountVcapVolumes(&pod)
+			err := ext.MountVcapVolumes(ctx, "eirini", &pod)
 			Expect(err).To(HaveOccurred())
 		})
 	})
@@ -0,0 +1,136 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AppGUIDLabel is the label of Eirini pods containing the app guid
+	AppGUIDLabel = "cloudfoundry.org/app_guid"
+	// SpaceGUIDLabel is the label of Eirini pods containing the space guid
+	SpaceGUIDLabel = "cloudfoundry.org/space_guid"
+	// ProvisionedLabel is the label set on the claims created by the extension
+	ProvisionedLabel = "eirini-persi.cloudfoundry.org/provisioned"
+)
+
+// podMetadata returns the pod label with the given key, falling back to the annotation with the same key
+func podMetadata(pod *corev1.Pod, key string) string {
+	if v, ok := pod.Labels[key]; ok {
+		return v
+	}
+	return pod.Annotations[key]
+}
+
+// newClaim returns the claim to create for the service given as argument
+func newClaim(namespace string, pod *corev1.Pod, service VcapService) (*corev1.PersistentVolumeClaim, error) {
+	size, err := resource.ParseQuantity(service.Credentials.Size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size %q for claim %s: %w", service.Credentials.Size, service.Credentials.VolumeID, err)
+	}
+
+	// Claims are shared among the app instances unless all the mounts are exclusive
+	accessMode := corev1.ReadWriteOnce
+	for _, volumeMount := range service.VolumeMounts {
+		if volumeMount.DeviceType != DeviceTypeExclusive {
+			accessMode = corev1.ReadWriteMany
+		}
+	}
+
+	labels := map[string]string{ProvisionedLabel: "true"}
+	for _, key := range []string{AppGUIDLabel, SpaceGUIDLabel} {
+		if v := podMetadata(pod, key); v != "" {
+			labels[key] = v
+		}
+	}
+
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      service.Credentials.VolumeID,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{accessMode},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+			},
+		},
+	}
+	if service.Credentials.StorageClass != "" {
+		claim.Spec.StorageClassName = &service.Credentials.StorageClass
+	}
+	return claim, nil
+}
+
+// ProvisionClaims creates the claims of the services declaring a size which don't exist yet in the namespace.
+// Claims created concurrently, e.g. by other instances of the same app, are left untouched.
+// It returns the provisioned claims, by name.
+func (ext *Extension) ProvisionClaims(ctx context.Context, namespace string, pod *corev1.Pod) (map[string]*corev1.PersistentVolumeClaim, error) {
+	services, err := ext.resolveServices(ctx, namespace, pod)
+	if err != nil {
+		return nil, err
+	}
+	claims, missing, err := ext.planClaims(ctx, namespace, pod, services.all(pod))
+	if err != nil {
+		return nil, err
+	}
+	if err := ext.createClaims(ctx, namespace, missing); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// planClaims looks up the claims of the services of the pod declaring a size. It returns these claims by name, where the
+// missing ones are the claims to create, which are also returned in the order of the services
+func (ext *Extension) planClaims(ctx context.Context, namespace string, pod *corev1.Pod, services []VcapService) (map[string]*corev1.PersistentVolumeClaim, []*corev1.PersistentVolumeClaim, error) {
+	claims := map[string]*corev1.PersistentVolumeClaim{}
+	var missing []*corev1.PersistentVolumeClaim
+
+	for _, service := range services {
+		if !service.isClaim() || service.Credentials.Size == "" {
+			continue
+		}
+		claimName := service.Credentials.VolumeID
+		if _, done := claims[claimName]; done {
+			continue
+		}
+		if ext.Client == nil {
+			return nil, nil, errors.New("no kubernetes client available to provision the claims")
+		}
+
+		claim, err := ext.getClaim(ctx, namespace, claimName)
+		if err != nil {
+			return nil, nil, err
+		}
+		if claim == nil {
+			claim, err = newClaim(namespace, pod, service)
+			if err != nil {
+				return nil, nil, err
+			}
+			missing = append(missing, claim)
+		}
+		claims[claimName] = claim
+	}
+	return claims, missing, nil
+}
+
+// createClaims creates the claims given as argument, leaving alone the ones created concurrently
+func (ext *Extension) createClaims(ctx context.Context, namespace string, claims []*corev1.PersistentVolumeClaim) error {
+	for _, claim := range claims {
+		ext.Logger.Infof("Creating claim %s (%s) of size %s", claim.Name, namespace, claim.Spec.Resources.Requests.Storage().String())
+		err := ext.Client.Create(ctx, claim)
+		if apierrors.IsAlreadyExists(err) {
+			ext.Logger.Debugf("Claim %s (%s) was created concurrently", claim.Name, namespace)
+		} else if err != nil {
+			return fmt.Errorf("creating claim %s: %w", claim.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package persistence_test
+
+import (
+	"context"
+	"encoding/json"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinix "code.cloudfoundry.org/eirinix"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cfakes "code.cloudfoundry.org/eirini-persi/pkg/controllers/fakes"
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Claims provisioning", func() {
+	var (
+		eiriniManager eirinix.Manager
+		fakeClient    *cfakes.FakeClient
+		ctx           context.Context
+		env           testing.Catalog
+		ext           *persistence.Extension
+		claims        map[string]corev1.PersistentVolumeClaim
+	)
+
+	BeforeEach(func() {
+		claims = map[string]corev1.PersistentVolumeClaim{}
+		fakeClient = &cfakes.FakeClient{}
+		fakeClient.GetCalls(func(_ context.Context, nn types.NamespacedName, obj runtime.Object) error {
+			claim, ok := claims[nn.Name]
+			if !ok {
+				return apierrors.NewNotFound(schema.GroupResource{Resource: "persistentvolumeclaims"}, nn.Name)
+			}
+			claim.DeepCopyInto(obj.(*corev1.PersistentVolumeClaim))
+			return nil
+		})
+
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		eiriniManager = eirinixcat.SimpleManager()
+
+		var ok bool
+		ext, ok = persistence.New().(*persistence.Extension)
+		Expect(ok).To(BeTrue())
+		ext.Logger = eiriniManager.GetLogger()
+		ext.Client = fakeClient
+	})
+
+	Describe("ProvisionClaims", func() {
+		It("creates missing claims declaring a size", func() {
+			pod := env.ProvisionedPersiApp("foo")
+
+			claims, err := ext.ProvisionClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims).To(HaveKey("the-volume-id"))
+			Expect(fakeClient.CreateCallCount()).To(Equal(1))
+
+			_, obj, _ := fakeClient.CreateArgsForCall(0)
+			claim := obj.(*corev1.PersistentVolumeClaim)
+			Expect(claim.Name).To(Equal("the-volume-id"))
+			Expect(claim.Namespace).To(Equal("eirini"))
+			Expect(claim.Labels).To(Equal(map[string]string{
+				"eirini-persi.cloudfoundry.org/provisioned": "true",
+				"cloudfoundry.org/app_guid":                 "app-guid",
+				"cloudfoundry.org/space_guid":               "space-guid",
+			}))
+			Expect(*claim.Spec.StorageClassName).To(Equal("fast"))
+			Expect(claim.Spec.AccessModes).To(ConsistOf(corev1.ReadWriteMany))
+			Expect(claim.Spec.Resources.Requests[corev1.ResourceStorage]).To(Equal(resource.MustParse("1Gi")))
+		})
+
+		It("does not create existing claims", func() {
+			claims["the-volume-id"] = env.PersistentVolumeClaim("the-volume-id", corev1.ReadWriteMany)
+			pod := env.ProvisionedPersiApp("foo")
+
+			_, err := ext.ProvisionClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.CreateCallCount()).To(Equal(0))
+		})
+
+		It("does not create claims without a size", func() {
+			pod := env.SimplePersiApp("foo")
+
+			claims, err := ext.ProvisionClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims).To(BeEmpty())
+			Expect(fakeClient.GetCallCount()).To(Equal(0))
+			Expect(fakeClient.CreateCallCount()).To(Equal(0))
+		})
+
+		It("tolerates claims created concurrently", func() {
+			fakeClient.CreateCalls(func(_ context.Context, obj runtime.Object, _ ...client.CreateOption) error {
+				return apierrors.NewAlreadyExists(schema.GroupResource{Resource: "persistentvolumeclaims"}, "the-volume-id")
+			})
+			pod := env.ProvisionedPersiApp("foo")
+
+			claims, err := ext.ProvisionClaims(ctx, "eirini", &pod)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(claims).To(HaveKey("the-volume-id"))
+		})
+
+		It("returns an error if the size is invalid", func() {
+			pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "the-volume-id", "size": "big"}, "volume_mounts": [{"container_dir": "/data"}]}]}`)
+
+			_, err := ext.ProvisionClaims(ctx, "eirini", &pod)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`invalid size "big"`))
+		})
+	})
+
+	Describe("Handle", func() {
+		It("validates the provisioned claims", func() {
+			ext.Options.ClaimValidation = persistence.ClaimValidationDeny
+			pod := env.ProvisionedPersiApp("foo")
+			raw, _ := json.Marshal(&pod)
+			request := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Namespace: "eirini"}}
+			request.Object.Raw = raw
+
+			resp := ext.Handle(ctx, eiriniManager, &pod, request)
+			Expect(resp.AdmissionResponse.Allowed).To(BeTrue())
+			Expect(fakeClient.CreateCallCount()).To(Equal(1))
+			Expect(fakeClient.GetCallCount()).To(Equal(1))
+		})
+
+		It("creates no claims nor secrets for pods which are denied", func() {
+			ext.Options.ClaimValidation = persistence.ClaimValidationDeny
+			pod := env.DefaultEiriniAppPod("foo", `{"eirini-persi": [
+				{"credentials": {"volume_id": "the-volume-id", "size": "1Gi"}, "volume_mounts": [{"container_dir": "/data"}]},
+				{"credentials": {"share": "//smb.example.com/data", "username": "alice", "password": "secret"}, "volume_mounts": [{"container_dir": "/smb"}]},
+				{"credentials": {"volume_id": "missing-volume-id"}, "volume_mounts": [{"container_dir": "/missing"}]}
+			]}`)
+			raw, _ := json.Marshal(&pod)
+			request := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Namespace: "eirini"}}
+			request.Object.Raw = raw
+
+			resp := ext.Handle(ctx, eiriniManager, &pod, request)
+			Expect(resp.AdmissionResponse.Allowed).To(BeFalse())
+			Expect(string(resp.Result.Reason)).To(ContainSubstring("claim missing-volume-id not found"))
+			Expect(fakeClient.CreateCallCount()).To(Equal(0))
+			Expect(fakeClient.UpdateCallCount()).To(Equal(0))
+		})
+	})
+})
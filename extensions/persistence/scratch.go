@@ -0,0 +1,103 @@
+package persistence
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// scratchVolumeID returns the id of the scratch volume of the service: its volume id if any, its first container_dir otherwise
+func (s VcapService) scratchVolumeID() string {
+	if s.Credentials.VolumeID != "" || len(s.VolumeMounts) == 0 {
+		return s.Credentials.VolumeID
+	}
+	return VolumeKindScratch + s.VolumeMounts[0].ContainerDir
+}
+
+// scratchSizeLimit returns the size limit of the scratch volume of the service, or nil if it has none
+func (s VcapService) scratchSizeLimit() (*resource.Quantity, error) {
+	if s.Credentials.SizeLimit == "" {
+		return nil, nil
+	}
+	size, err := resource.ParseQuantity(s.Credentials.SizeLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size limit %q for scratch volume %s: %w", s.Credentials.SizeLimit, s.scratchVolumeID(), err)
+	}
+	return &size, nil
+}
+
+// scratchVolumeSource returns the empty dir source of the scratch volume of the service
+func (s VcapService) scratchVolumeSource() (corev1.VolumeSource, error) {
+	medium := corev1.StorageMedium(s.Credentials.Medium)
+	if medium != corev1.StorageMediumDefault && medium != corev1.StorageMediumMemory {
+		return corev1.VolumeSource{}, fmt.Errorf("invalid medium %q for scratch volume %s: must be empty or %q", medium, s.scratchVolumeID(), corev1.StorageMediumMemory)
+	}
+	size, err := s.scratchSizeLimit()
+	if err != nil {
+		return corev1.VolumeSource{}, err
+	}
+	return corev1.VolumeSource{
+		EmptyDir: &corev1.EmptyDirVolumeSource{
+			Medium:    medium,
+			SizeLimit: size,
+		},
+	}, nil
+}
+
+// requestScratchSpace adds the size limit of the scratch volume of the service to the requests of the container, and to
+// its limits if it has any, so that it is scheduled on a node with enough space: memory for tmpfs, ephemeral storage otherwise.
+// The added requests and limits are returned
+func (s VcapService) requestScratchSpace(c *corev1.Container) (corev1.ResourceRequirements, error) {
+	size, err := s.scratchSizeLimit()
+	if err != nil || size == nil {
+		return corev1.ResourceRequirements{}, err
+	}
+	added := corev1.ResourceRequirements{}
+
+	name := corev1.ResourceEphemeralStorage
+	if corev1.StorageMedium(s.Credentials.Medium) == corev1.StorageMediumMemory {
+		name = corev1.ResourceMemory
+	}
+
+	if c.Resources.Requests == nil {
+		c.Resources.Requests = corev1.ResourceList{}
+	}
+	request := c.Resources.Requests[name]
+	request.Add(*size)
+	c.Resources.Requests[name] = request
+	added.Requests = corev1.ResourceList{name: *size}
+
+	if limit, ok := c.Resources.Limits[name]; ok {
+		limit.Add(*size)
+		c.Resources.Limits[name] = limit
+		added.Limits = corev1.ResourceList{name: *size}
+	}
+	return added, nil
+}
+
+// releaseResources subtracts the requests and limits given as argument from the ones of the container
+func releaseResources(c *corev1.Container, released corev1.ResourceRequirements) {
+	c.Resources.Requests = subtractResources(c.Resources.Requests, released.Requests)
+	c.Resources.Limits = subtractResources(c.Resources.Limits, released.Limits)
+}
+
+// subtractResources subtracts the resources given as argument from the list, dropping the ones which are used up
+func subtractResources(list, released corev1.ResourceList) corev1.ResourceList {
+	for name, quantity := range released {
+		current, ok := list[name]
+		if !ok {
+			continue
+		}
+		current.Sub(quantity)
+		if current.Sign() <= 0 {
+			delete(list, name)
+		} else {
+			list[name] = current
+		}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
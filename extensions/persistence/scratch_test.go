@@ -0,0 +1,89 @@
+package persistence_test
+
+import (
+	"context"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Scratch volumes", func() {
+	var (
+		env testing.Catalog
+		ctx context.Context
+		ext *persistence.Extension
+	)
+
+	scratchApp := func(credentials string) corev1.Pod {
+		return env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": `+credentials+`, "volume_mounts": [{"container_dir": "/scratch"}]}]}`)
+	}
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		ext = &persistence.Extension{Logger: eirinixcat.SimpleManager().GetLogger()}
+	})
+
+	It("mounts an empty dir and requests its ephemeral storage", func() {
+		pod := scratchApp(`{"kind": "scratch", "size_limit": "2Gi"}`)
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		emptyDir := pod.Spec.Volumes[0].EmptyDir
+		Expect(emptyDir.Medium).To(Equal(corev1.StorageMediumDefault))
+		Expect(emptyDir.SizeLimit.String()).To(Equal("2Gi"))
+		Expect(pod.Spec.Containers[0].VolumeMounts[0].Name).To(Equal(pod.Spec.Volumes[0].Name))
+		Expect(pod.Spec.Containers[0].VolumeMounts[0].MountPath).To(Equal("/scratch"))
+		Expect(pod.Spec.Containers[0].Resources.Requests.StorageEphemeral().String()).To(Equal("2Gi"))
+		Expect(pod.Spec.Containers[0].Resources.Limits).To(BeEmpty())
+	})
+
+	It("backs memory scratch volumes with a tmpfs and adds them to the memory of the container", func() {
+		pod := scratchApp(`{"kind": "scratch", "volume_id": "tmp", "size_limit": "64Mi", "medium": "Memory"}`)
+		pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Mi")},
+			Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")},
+		}
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes[0].Name).To(Equal("tmp"))
+		Expect(pod.Spec.Volumes[0].EmptyDir.Medium).To(Equal(corev1.StorageMediumMemory))
+		Expect(pod.Spec.Containers[0].Resources.Requests.Memory().String()).To(Equal("192Mi"))
+		Expect(pod.Spec.Containers[0].Resources.Limits.Memory().String()).To(Equal("320Mi"))
+		Expect(pod.Spec.Containers[0].Resources.Requests).ToNot(HaveKey(corev1.ResourceEphemeralStorage))
+	})
+
+	It("requests the space once", func() {
+		pod := scratchApp(`{"kind": "scratch", "size_limit": "1Gi"}`)
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		Expect(pod.Spec.Containers[0].Resources.Requests.StorageEphemeral().String()).To(Equal("1Gi"))
+	})
+
+	It("does not request anything without size limit", func() {
+		pod := scratchApp(`{"kind": "scratch"}`)
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes[0].EmptyDir.SizeLimit).To(BeNil())
+		Expect(pod.Spec.Containers[0].Resources.Requests).To(BeEmpty())
+	})
+
+	It("rejects invalid mediums, sizes and kinds", func() {
+		pod := scratchApp(`{"kind": "scratch", "medium": "HugePages"}`)
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(MatchError(ContainSubstring(`invalid medium "HugePages"`)))
+
+		pod = scratchApp(`{"kind": "scratch", "size_limit": "big"}`)
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(MatchError(ContainSubstring(`invalid size limit "big"`)))
+
+		pod = scratchApp(`{"kind": "tape", "volume_id": "backup"}`)
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(MatchError(ContainSubstring(`invalid volume kind "tape" for volume backup`)))
+	})
+})
@@ -0,0 +1,255 @@
+package persistence
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	eirinix "code.cloudfoundry.org/eirinix"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// SMBDriver is the CSI driver mounting the SMB shares
+	SMBDriver = "smb.csi.k8s.io"
+	// SMBServiceLabel is the VCAP_SERVICES key of the services of smb-volume-release
+	SMBServiceLabel = "smb"
+	// SMBSecretLabel is the label set on the credentials secrets of the SMB shares created by the extension
+	SMBSecretLabel = "eirini-persi.cloudfoundry.org/smb-credentials"
+	// SMBSecretPrefix is the prefix of the names of the credentials secrets of the SMB shares
+	SMBSecretPrefix = "eirini-persi-smb-"
+
+	// DefaultSMBSecretGracePeriod is how long unreferenced credentials secrets are kept, as they are
+	// created before the pods referencing them
+	DefaultSMBSecretGracePeriod = 5 * time.Minute
+
+	// smbSecretHashLength is the length of the hash naming the credentials secrets
+	smbSecretHashLength = 16
+)
+
+// smbSecretName returns the name of the credentials secret of the SMB service. It changes with the credentials,
+// so that pods using rotated credentials don't share the secret of the pods using the previous ones
+func (s VcapService) smbSecretName() string {
+	sum := sha256.Sum256([]byte(s.Credentials.Share + "\x00" + s.Credentials.Username + "\x00" + s.Credentials.Password))
+	return SMBSecretPrefix + hex.EncodeToString(sum[:])[:smbSecretHashLength]
+}
+
+// smbVolumeSource returns the CSI volume source mounting the SMB share of the service
+func (s VcapService) smbVolumeSource(readOnly bool) corev1.VolumeSource {
+	attributes := map[string]string{"source": s.Credentials.Share}
+	if s.Credentials.MountOptions != "" {
+		attributes["mountOptions"] = s.Credentials.MountOptions
+	}
+	return corev1.VolumeSource{
+		CSI: &corev1.CSIVolumeSource{
+			Driver:               SMBDriver,
+			ReadOnly:             &readOnly,
+			VolumeAttributes:     attributes,
+			NodePublishSecretRef: &corev1.LocalObjectReference{Name: s.smbSecretName()},
+		},
+	}
+}
+
+// newSMBSecret returns the credentials secret of the SMB service given as argument
+func newSMBSecret(namespace string, service VcapService) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      service.smbSecretName(),
+			Namespace: namespace,
+			Labels:    map[string]string{SMBSecretLabel: "true"},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			"username": []byte(service.Credentials.Username),
+			"password": []byte(service.Credentials.Password),
+		},
+	}
+}
+
+// ProvisionSMBSecrets creates, or updates, the credentials secrets of the SMB shares mounted by the pod in the namespace given as argument
+func (ext *Extension) ProvisionSMBSecrets(ctx context.Context, namespace string, pod *corev1.Pod) error {
+	services, err := ext.resolveServices(ctx, namespace, pod)
+	if err != nil {
+		return err
+	}
+	return ext.provisionSMBSecrets(ctx, namespace, services.all(pod))
+}
+
+// provisionSMBSecrets provisions the credentials secrets of the SMB shares of the services given as argument
+func (ext *Extension) provisionSMBSecrets(ctx context.Context, namespace string, services []VcapService) error {
+	for _, service := range services {
+		if service.kind() != VolumeKindSMB {
+			continue
+		}
+		if ext.Client == nil {
+			return fmt.Errorf("no kubernetes client available to provision the credentials of share %s", service.Credentials.Share)
+		}
+
+		secret := newSMBSecret(namespace, service)
+		existing := &corev1.Secret{}
+		err := ext.reader().Get(ctx, types.NamespacedName{Namespace: namespace, Name: secret.Name}, existing)
+		if apierrors.IsNotFound(err) {
+			ext.Logger.Infof("Creating credentials secret %s (%s) of share %s", secret.Name, namespace, service.Credentials.Share)
+			err = ext.Client.Create(ctx, secret)
+			if apierrors.IsAlreadyExists(err) {
+				continue
+			}
+		} else if err == nil && !reflect.DeepEqual(existing.Data, secret.Data) {
+			ext.Logger.Infof("Updating credentials secret %s (%s) of share %s", secret.Name, namespace, service.Credentials.Share)
+			existing.Data = secret.Data
+			err = ext.Client.Update(ctx, existing)
+		}
+		if err != nil {
+			return fmt.Errorf("provisioning credentials secret %s of share %s: %w", secret.Name, service.Credentials.Share, err)
+		}
+	}
+	return nil
+}
+
+// SMBSecretCollector is a watcher deleting the credentials secrets of the SMB shares which are no longer
+// referenced by pods of their namespace, once Eirini apps are deleted
+type SMBSecretCollector struct {
+	Logger *zap.SugaredLogger
+	// Client is used to delete the secrets
+	Client client.Client
+	// Reader is used to list the secrets, pods and StatefulSets. If not set, the API reader of the Eirini manager is
+	// used, so that collecting neither waits for informers to sync nor caches every secret of the namespace
+	Reader client.Reader
+	// StatefulSets also counts the references of the pod templates of the StatefulSets, whose pods may not
+	// be created yet in statefulset mode
+	StatefulSets bool
+	// GracePeriod is how long unreferenced secrets are kept. Defaults to DefaultSMBSecretGracePeriod
+	GracePeriod time.Duration
+	// Now returns the current time. Defaults to time.Now
+	Now func() time.Time
+}
+
+// SelectsSMBServices returns true if the services of smb-volume-release, labelled SMBServiceLabel,
+// can be selected with the options
+func (o Options) SelectsSMBServices() bool {
+	if o.AllVolumeServices {
+		return true
+	}
+	for _, label := range o.ServiceLabels {
+		if label == SMBServiceLabel {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSMBSecretCollector returns a watcher collecting the unreferenced credentials secrets of the SMB shares
+func NewSMBSecretCollector() eirinix.Watcher {
+	return NewSMBSecretCollectorWithOptions(Options{})
+}
+
+// NewSMBSecretCollectorWithOptions returns a watcher collecting the unreferenced credentials secrets of the SMB shares
+// mounted by the persi extension configured with the given options
+func NewSMBSecretCollectorWithOptions(opts Options) eirinix.Watcher {
+	return &SMBSecretCollector{StatefulSets: opts.StatefulSetMode}
+}
+
+// Handle implements eirinix.Watcher
+func (c *SMBSecretCollector) Handle(eiriniManager eirinix.Manager, e watch.Event) {
+	if e.Type != watch.Deleted {
+		return
+	}
+	pod, ok := e.Object.(*corev1.Pod)
+	if !ok {
+		return
+	}
+
+	if c.Logger == nil {
+		c.Logger = eiriniManager.GetLogger()
+	}
+	if kubeManager := eiriniManager.GetKubeManager(); kubeManager != nil {
+		if c.Client == nil {
+			c.Client = kubeManager.GetClient()
+		}
+		if c.Reader == nil {
+			c.Reader = kubeManager.GetAPIReader()
+		}
+	}
+
+	if err := c.Collect(eiriniManager.GetContext(), pod.Namespace); err != nil {
+		c.Logger.Errorf("Collecting the credentials secrets of namespace %s: %s", pod.Namespace, err.Error())
+	}
+}
+
+// Collect deletes the credentials secrets of the namespace given as argument which are not referenced by any pod,
+// nor by any StatefulSet if StatefulSets is set, and are older than the grace period
+func (c *SMBSecretCollector) Collect(ctx context.Context, namespace string) error {
+	if c.Client == nil {
+		return errors.New("no kubernetes client available to collect the credentials secrets")
+	}
+	reader := c.Reader
+	if reader == nil {
+		reader = c.Client
+	}
+	gracePeriod := c.GracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = DefaultSMBSecretGracePeriod
+	}
+	now := time.Now
+	if c.Now != nil {
+		now = c.Now
+	}
+
+	secrets := &corev1.SecretList{}
+	if err := reader.List(ctx, secrets, client.InNamespace(namespace), client.MatchingLabels{SMBSecretLabel: "true"}); err != nil {
+		return fmt.Errorf("listing credentials secrets: %w", err)
+	}
+	if len(secrets.Items) == 0 {
+		return nil
+	}
+
+	pods := &corev1.PodList{}
+	if err := reader.List(ctx, pods, client.InNamespace(namespace)); err != nil {
+		return fmt.Errorf("listing pods: %w", err)
+	}
+	referenced := map[string]bool{}
+	for _, pod := range pods.Items {
+		addSecretReferences(referenced, pod.Spec.Volumes)
+	}
+	if c.StatefulSets {
+		statefulSets := &appsv1.StatefulSetList{}
+		if err := reader.List(ctx, statefulSets, client.InNamespace(namespace)); err != nil {
+			return fmt.Errorf("listing statefulsets: %w", err)
+		}
+		for _, statefulSet := range statefulSets.Items {
+			addSecretReferences(referenced, statefulSet.Spec.Template.Spec.Volumes)
+		}
+	}
+
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if referenced[secret.Name] || now().Sub(secret.CreationTimestamp.Time) < gracePeriod {
+			continue
+		}
+		c.Logger.Infof("Deleting unreferenced credentials secret %s (%s)", secret.Name, namespace)
+		if err := c.Client.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("deleting credentials secret %s: %w", secret.Name, err)
+		}
+	}
+	return nil
+}
+
+// addSecretReferences adds the secrets referenced by the CSI volumes given as argument to the referenced ones
+func addSecretReferences(referenced map[string]bool, volumes []corev1.Volume) {
+	for _, volume := range volumes {
+		if volume.CSI != nil && volume.CSI.NodePublishSecretRef != nil {
+			referenced[volume.CSI.NodePublishSecretRef.Name] = true
+		}
+	}
+}
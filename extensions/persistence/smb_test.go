@@ -0,0 +1,231 @@
+package persistence_test
+
+import (
+	"context"
+	"time"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinix "code.cloudfoundry.org/eirinix"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	crclient "sigs.k8s.io/controller-runtime/pkg/client"
+
+	cfakes "code.cloudfoundry.org/eirini-persi/pkg/controllers/fakes"
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("SMB volumes", func() {
+	var (
+		eiriniManager eirinix.Manager
+		client        *cfakes.FakeClient
+		ctx           context.Context
+		env           testing.Catalog
+		ext           *persistence.Extension
+		secrets       map[string]corev1.Secret
+	)
+
+	smbApp := func(password string) corev1.Pod {
+		return env.DefaultEiriniAppPod("foo", `{"smb": [{"credentials": {"share": "//smb.example.com/data", "username": "alice", "password": "`+password+`", "mount_options": "vers=3.0"}, "volume_mounts": [{"container_dir": "/data"}]}]}`)
+	}
+
+	BeforeEach(func() {
+		secrets = map[string]corev1.Secret{}
+		client = &cfakes.FakeClient{}
+		client.GetCalls(func(_ context.Context, nn types.NamespacedName, obj runtime.Object) error {
+			secret, ok := secrets[nn.Name]
+			if !ok {
+				return apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, nn.Name)
+			}
+			secret.DeepCopyInto(obj.(*corev1.Secret))
+			return nil
+		})
+
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		eiriniManager = eirinixcat.SimpleManager()
+		ext = &persistence.Extension{
+			Logger:  eiriniManager.GetLogger(),
+			Client:  client,
+			Options: persistence.Options{ServiceLabels: []string{"smb"}},
+		}
+	})
+
+	It("mounts the share with the SMB CSI driver", func() {
+		pod := smbApp("secret")
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		csi := pod.Spec.Volumes[0].CSI
+		Expect(csi.Driver).To(Equal(persistence.SMBDriver))
+		Expect(*csi.ReadOnly).To(BeFalse())
+		Expect(csi.VolumeAttributes).To(Equal(map[string]string{"source": "//smb.example.com/data", "mountOptions": "vers=3.0"}))
+		Expect(csi.NodePublishSecretRef.Name).To(HavePrefix(persistence.SMBSecretPrefix))
+		Expect(pod.Spec.Containers[0].VolumeMounts[0].Name).To(Equal(pod.Spec.Volumes[0].Name))
+	})
+
+	It("references a different secret when the credentials change", func() {
+		pod, rotated := smbApp("secret"), smbApp("rotated")
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &rotated)).To(Succeed())
+		Expect(pod.Spec.Volumes[0].CSI.NodePublishSecretRef.Name).ToNot(Equal(rotated.Spec.Volumes[0].CSI.NodePublishSecretRef.Name))
+	})
+
+	Describe("ProvisionSMBSecrets", func() {
+		It("creates the credentials secret referenced by the volume", func() {
+			pod := smbApp("secret")
+			Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+
+			Expect(ext.ProvisionSMBSecrets(ctx, "eirini", &pod)).To(Succeed())
+			Expect(client.CreateCallCount()).To(Equal(1))
+			_, obj, _ := client.CreateArgsForCall(0)
+			secret := obj.(*corev1.Secret)
+			Expect(secret.Name).To(Equal(pod.Spec.Volumes[0].CSI.NodePublishSecretRef.Name))
+			Expect(secret.Namespace).To(Equal("eirini"))
+			Expect(secret.Labels).To(HaveKeyWithValue(persistence.SMBSecretLabel, "true"))
+			Expect(secret.Data).To(Equal(map[string][]byte{"username": []byte("alice"), "password": []byte("secret")}))
+		})
+
+		It("restores secrets which were changed", func() {
+			pod := smbApp("secret")
+			Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+			name := pod.Spec.Volumes[0].CSI.NodePublishSecretRef.Name
+			secrets[name] = corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name}, Data: map[string][]byte{"username": []byte("bob")}}
+
+			Expect(ext.ProvisionSMBSecrets(ctx, "eirini", &pod)).To(Succeed())
+			Expect(client.CreateCallCount()).To(Equal(0))
+			Expect(client.UpdateCallCount()).To(Equal(1))
+			_, obj, _ := client.UpdateArgsForCall(0)
+			Expect(obj.(*corev1.Secret).Data).To(HaveKeyWithValue("password", []byte("secret")))
+		})
+
+		It("leaves up to date secrets alone", func() {
+			pod := smbApp("secret")
+			Expect(ext.ProvisionSMBSecrets(ctx, "eirini", &pod)).To(Succeed())
+			_, obj, _ := client.CreateArgsForCall(0)
+			secrets[obj.(*corev1.Secret).Name] = *obj.(*corev1.Secret)
+
+			Expect(ext.ProvisionSMBSecrets(ctx, "eirini", &pod)).To(Succeed())
+			Expect(client.CreateCallCount()).To(Equal(1))
+			Expect(client.UpdateCallCount()).To(Equal(0))
+		})
+	})
+
+	Describe("SMBSecretCollector", func() {
+		var (
+			collector *persistence.SMBSecretCollector
+			pods      []corev1.Pod
+			now       time.Time
+		)
+
+		secret := func(name string, age time.Duration) corev1.Secret {
+			return corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "eirini",
+				CreationTimestamp: metav1.NewTime(now.Add(-age)),
+			}}
+		}
+
+		BeforeEach(func() {
+			now = time.Now()
+			pod := smbApp("secret")
+			Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+			pods = []corev1.Pod{pod}
+			secrets = map[string]corev1.Secret{
+				"referenced": secret(pod.Spec.Volumes[0].CSI.NodePublishSecretRef.Name, time.Hour),
+				"stale":      secret(persistence.SMBSecretPrefix+"stale", time.Hour),
+				"fresh":      secret(persistence.SMBSecretPrefix+"fresh", time.Minute),
+			}
+			client.ListCalls(func(_ context.Context, list runtime.Object, _ ...crclient.ListOption) error {
+				switch l := list.(type) {
+				case *corev1.SecretList:
+					for _, s := range secrets {
+						l.Items = append(l.Items, s)
+					}
+				case *corev1.PodList:
+					l.Items = pods
+				}
+				return nil
+			})
+			collector = &persistence.SMBSecretCollector{Logger: eiriniManager.GetLogger(), Client: client, Now: func() time.Time { return now }}
+		})
+
+		It("deletes the unreferenced secrets older than the grace period", func() {
+			Expect(collector.Collect(ctx, "eirini")).To(Succeed())
+			Expect(client.DeleteCallCount()).To(Equal(1))
+			_, obj, _ := client.DeleteArgsForCall(0)
+			Expect(obj.(*corev1.Secret).Name).To(Equal(persistence.SMBSecretPrefix + "stale"))
+		})
+
+		It("only lists the credentials secrets of the namespace", func() {
+			Expect(collector.Collect(ctx, "eirini")).To(Succeed())
+			_, _, opts := client.ListArgsForCall(0)
+			listOpts := &crclient.ListOptions{}
+			listOpts.ApplyOptions(opts)
+			Expect(listOpts.Namespace).To(Equal("eirini"))
+			Expect(listOpts.LabelSelector.String()).To(Equal(persistence.SMBSecretLabel + "=true"))
+		})
+
+		It("keeps the secrets referenced by StatefulSets in statefulset mode", func() {
+			statefulSet := env.EiriniAppStatefulSet("foo", `{}`)
+			statefulSet.Spec.Template.Spec.Volumes = pods[0].Spec.Volumes
+			pods = nil
+			client.ListCalls(func(_ context.Context, list runtime.Object, _ ...crclient.ListOption) error {
+				switch l := list.(type) {
+				case *corev1.SecretList:
+					for _, s := range secrets {
+						l.Items = append(l.Items, s)
+					}
+				case *appsv1.StatefulSetList:
+					l.Items = []appsv1.StatefulSet{statefulSet}
+				}
+				return nil
+			})
+
+			Expect(collector.Collect(ctx, "eirini")).To(Succeed())
+			Expect(client.DeleteCallCount()).To(Equal(2))
+
+			collector.StatefulSets = true
+			Expect(collector.Collect(ctx, "eirini")).To(Succeed())
+			Expect(client.DeleteCallCount()).To(Equal(3))
+			_, obj, _ := client.DeleteArgsForCall(2)
+			Expect(obj.(*corev1.Secret).Name).To(Equal(persistence.SMBSecretPrefix + "stale"))
+		})
+
+		It("lists with the reader rather than the client", func() {
+			reader := client
+			client = &cfakes.FakeClient{}
+			collector.Client, collector.Reader = client, reader
+
+			Expect(collector.Collect(ctx, "eirini")).To(Succeed())
+			Expect(reader.ListCallCount()).To(Equal(2))
+			Expect(client.ListCallCount()).To(BeZero())
+			Expect(client.DeleteCallCount()).To(Equal(1))
+		})
+
+		It("is only needed when SMB services can be selected", func() {
+			Expect(persistence.Options{}.SelectsSMBServices()).To(BeFalse())
+			Expect(persistence.Options{ServiceLabels: []string{"eirini-persi", "nfs"}}.SelectsSMBServices()).To(BeFalse())
+			Expect(persistence.Options{ServiceLabels: []string{"eirini-persi", persistence.SMBServiceLabel}}.SelectsSMBServices()).To(BeTrue())
+			Expect(persistence.Options{AllVolumeServices: true}.SelectsSMBServices()).To(BeTrue())
+		})
+
+		It("collects when app pods are deleted", func() {
+			pod := pods[0]
+			collector.Handle(eiriniManager, watch.Event{Type: watch.Modified, Object: &pod})
+			Expect(client.ListCallCount()).To(Equal(0))
+
+			collector.Handle(eiriniManager, watch.Event{Type: watch.Deleted, Object: &pod})
+			Expect(client.DeleteCallCount()).To(Equal(1))
+		})
+	})
+})
@@ -0,0 +1,224 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	eirinix "code.cloudfoundry.org/eirinix"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	// StatefulSetWebhookPath is the path of the webhook mutating the StatefulSets of Eirini apps
+	StatefulSetWebhookPath = "/statefulsets"
+	// eiriniApp is the value of the source type label of Eirini apps
+	eiriniApp = "APP"
+)
+
+// StatefulSetMutator mounts the volumes of Eirini apps in the pod template of their StatefulSets, instead of in
+// their pods, so that the volumes are part of the workload definition and binding changes trigger a rollout.
+// It is an eirinix.Reconciler, only to register its own webhook once the manager is set up
+type StatefulSetMutator struct {
+	Extension *Extension
+
+	decoder *admission.Decoder
+}
+
+// NewStatefulSetMutator returns the persi extension mutating StatefulSets, configured with the given options
+func NewStatefulSetMutator(opts Options) eirinix.Reconciler {
+	opts.StatefulSetMode = true
+	return &StatefulSetMutator{Extension: &Extension{Options: opts}}
+}
+
+// InjectDecoder injects the decoder of the StatefulSets in the admission requests
+func (m *StatefulSetMutator) InjectDecoder(d *admission.Decoder) error {
+	m.decoder = d
+	return nil
+}
+
+// Reconcile implements eirinix.Reconciler. StatefulSets are only mutated on admission
+func (m *StatefulSetMutator) Reconcile(reconcile.Request) (reconcile.Result, error) {
+	return reconcile.Result{}, nil
+}
+
+// Register registers the webhook mutating StatefulSets to the webhook server of the manager, and adds it to the
+// webhook configuration generated by the manager for the pod extensions.
+// It relies on the internals of the DefaultExtensionManager of eirinix v0.3.1-0.20200908072226-2c03042398ea, which has
+// no API for other webhooks: its KubeManager and WebhookConfig fields, the configuration being created before the
+// reconcilers are registered, and the namespace label of statefulSetWebhook. Check them when upgrading eirinix
+func (m *StatefulSetMutator) Register(eiriniManager eirinix.Manager) error {
+	defaultManager, ok := eiriniManager.(*eirinix.DefaultExtensionManager)
+	if !ok || defaultManager.KubeManager == nil {
+		return errors.New("the StatefulSet webhook needs a started eirinix manager")
+	}
+	kubeManager := defaultManager.KubeManager
+
+	ext := m.Extension
+	ext.Logger = eiriniManager.GetLogger().Named("statefulset")
+	if ext.Client == nil {
+		ext.Client = kubeManager.GetClient()
+	}
+	if ext.Reader == nil {
+		ext.Reader = kubeManager.GetAPIReader()
+	}
+	if ext.KubeVersionLookup == nil {
+		ext.KubeVersionLookup = kubeVersionLookup(eiriniManager)
+	}
+	if m.decoder == nil {
+		decoder, err := admission.NewDecoder(kubeManager.GetScheme())
+		if err != nil {
+			return err
+		}
+		m.decoder = decoder
+	}
+
+	opts := eiriniManager.GetManagerOptions()
+	webhook := statefulSetWebhook(opts)
+	webhook.Webhook = &admission.Webhook{Handler: m}
+	kubeManager.GetWebhookServer().Register(webhook.Path, webhook.Webhook)
+
+	if opts.RegisterWebHook != nil && !*opts.RegisterWebHook {
+		return nil
+	}
+
+	ctx := eiriniManager.GetContext()
+	config := &admissionregistrationv1beta1.MutatingWebhookConfiguration{}
+	// The cache of the manager client isn't started yet
+	if err := kubeManager.GetAPIReader().Get(ctx, types.NamespacedName{Name: defaultManager.WebhookConfig.ConfigName}, config); err != nil {
+		return fmt.Errorf("getting the webhook configuration %s: %w", defaultManager.WebhookConfig.ConfigName, err)
+	}
+	config.Webhooks = appendWebhooks(config.Webhooks, defaultManager.WebhookConfig.GenerateAdmissionWebhook([]eirinix.MutatingWebhook{webhook})...)
+	if err := kubeManager.GetClient().Update(ctx, config); err != nil {
+		return fmt.Errorf("adding the StatefulSet webhook to the webhook configuration %s: %w", config.Name, err)
+	}
+	return nil
+}
+
+// statefulSetWebhook returns the webhook mutating the StatefulSets of Eirini apps, with the settings of the manager
+func statefulSetWebhook(opts eirinix.ManagerOptions) *eirinix.DefaultMutatingWebhook {
+	scope := admissionregistrationv1beta1.NamespacedScope
+	webhook := &eirinix.DefaultMutatingWebhook{
+		Name:             fmt.Sprintf("statefulsets.%s.org", opts.OperatorFingerprint),
+		Path:             StatefulSetWebhookPath,
+		FilterEiriniApps: opts.FilterEiriniApps == nil || *opts.FilterEiriniApps,
+		Rules: []admissionregistrationv1beta1.RuleWithOperations{
+			{
+				Rule: admissionregistrationv1beta1.Rule{
+					APIGroups:   []string{appsv1.GroupName},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"statefulsets"},
+					Scope:       &scope,
+				},
+				Operations: []admissionregistrationv1beta1.OperationType{
+					admissionregistrationv1beta1.Create,
+					admissionregistrationv1beta1.Update,
+				},
+			},
+		},
+	}
+	if opts.FailurePolicy != nil {
+		webhook.FailurePolicy = *opts.FailurePolicy
+	}
+	if opts.Namespace != "" {
+		// Same label as the namespace selector of the pod webhooks, which eirinix doesn't export
+		webhook.NamespaceSelector = &metav1.LabelSelector{
+			MatchLabels: map[string]string{fmt.Sprintf("%s-ns", opts.OperatorFingerprint): opts.Namespace},
+		}
+	}
+	return webhook
+}
+
+// appendWebhooks appends the webhooks given as argument, replacing the existing webhooks with the same name
+func appendWebhooks(webhooks []admissionregistrationv1beta1.MutatingWebhook, added ...admissionregistrationv1beta1.MutatingWebhook) []admissionregistrationv1beta1.MutatingWebhook {
+	for _, a := range added {
+		replaced := false
+		for i := range webhooks {
+			if webhooks[i].Name == a.Name {
+				webhooks[i] = a
+				replaced = true
+			}
+		}
+		if !replaced {
+			webhooks = append(webhooks, a)
+		}
+	}
+	return webhooks
+}
+
+// MutatePodTemplate mounts the volumes of the services of the pod template given as argument, as the pod
+// extension does for pods. The name is the one of the workload owning the template
+func (ext *Extension) MutatePodTemplate(ctx context.Context, namespace, name string, template *corev1.PodTemplateSpec) admission.Response {
+	services, err := ext.resolveServices(ctx, namespace, &corev1.Pod{Spec: template.Spec})
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	return ext.mutatePodTemplate(ctx, namespace, name, template, services)
+}
+
+// mutatePodTemplate mutates the pod template with the services given as argument, as MutatePodTemplate does
+func (ext *Extension) mutatePodTemplate(ctx context.Context, namespace, name string, template *corev1.PodTemplateSpec, services appServices) admission.Response {
+	pod := &corev1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}
+	if pod.Name == "" {
+		pod.Name = name
+	}
+	pod.Namespace = namespace
+
+	if resp := ext.mutatePod(ctx, namespace, pod, services); !resp.Allowed {
+		return resp
+	}
+
+	pod.Name, pod.Namespace = template.Name, template.Namespace
+	template.ObjectMeta = pod.ObjectMeta
+	template.Spec = pod.Spec
+	return admission.Allowed("")
+}
+
+// Handle mounts the volumes of the StatefulSets of Eirini apps in their pod template
+func (m *StatefulSetMutator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if m.decoder == nil {
+		return admission.Errored(http.StatusInternalServerError, errors.New("No decoder injected"))
+	}
+	statefulSet := &appsv1.StatefulSet{}
+	if err := m.decoder.Decode(req, statefulSet); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if statefulSet.Labels[eirinix.LabelSourceType] != eiriniApp {
+		return admission.Allowed("")
+	}
+
+	namespace := req.Namespace
+	if namespace == "" {
+		namespace = statefulSet.Namespace
+	}
+	m.Extension.Logger.Debugf("Handling webhook request for StatefulSet: %s (%s)", statefulSet.Name, namespace)
+
+	statefulSetCopy := statefulSet.DeepCopy()
+	template := &statefulSetCopy.Spec.Template
+	// The services are resolved once, for the volumes of the template and for its claim templates
+	services, err := m.Extension.resolveServices(ctx, namespace, &corev1.Pod{Spec: template.Spec})
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if resp := m.Extension.mutatePodTemplate(ctx, namespace, statefulSet.Name, template, services); !resp.Allowed {
+		return resp
+	}
+	if err := m.Extension.setClaimTemplates(namespace, statefulSetCopy, services.all(&corev1.Pod{Spec: template.Spec}), req.Operation == admissionv1beta1.Update); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	marshaled, err := json.Marshal(statefulSetCopy)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
@@ -0,0 +1,320 @@
+package persistence_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinix "code.cloudfoundry.org/eirinix"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	jsonpatch "github.com/evanphx/json-patch"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cfakes "code.cloudfoundry.org/eirini-persi/pkg/controllers/fakes"
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("StatefulSet mutation", func() {
+	var (
+		ctx     context.Context
+		env     testing.Catalog
+		mutator *persistence.StatefulSetMutator
+	)
+
+	oneService := `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo"}]}]}`
+	twoServices := `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo"}]}, {"credentials": {"volume_id": "bar"}, "volume_mounts": [{"container_dir": "/bar", "mode": "r"}]}]}`
+
+	// handle returns the response of the mutator to the admission of the StatefulSet
+	handle := func(statefulSet appsv1.StatefulSet, operation admissionv1beta1.Operation) (admission.Response, []byte) {
+		raw, err := json.Marshal(&statefulSet)
+		Expect(err).ToNot(HaveOccurred())
+		request := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Namespace: "eirini", Operation: operation}}
+		request.Object.Raw = raw
+		return mutator.Handle(ctx, request), raw
+	}
+
+	// mutate returns the StatefulSet patched by the mutator
+	mutate := func(statefulSet appsv1.StatefulSet, operation admissionv1beta1.Operation) appsv1.StatefulSet {
+		resp, raw := handle(statefulSet, operation)
+		Expect(resp.Allowed).To(BeTrue(), "%v", resp.Result)
+
+		ops, err := json.Marshal(resp.Patches)
+		Expect(err).ToNot(HaveOccurred())
+		patch, err := jsonpatch.DecodePatch(ops)
+		Expect(err).ToNot(HaveOccurred())
+		patched, err := patch.Apply(raw)
+		Expect(err).ToNot(HaveOccurred())
+
+		var patchedStatefulSet appsv1.StatefulSet
+		Expect(json.Unmarshal(patched, &patchedStatefulSet)).To(Succeed())
+		return patchedStatefulSet
+	}
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		eiriniManager := eirinixcat.SimpleManager()
+		mutator = &persistence.StatefulSetMutator{Extension: &persistence.Extension{
+			Logger: eiriniManager.GetLogger(),
+			Client: &cfakes.FakeClient{},
+		}}
+		decoder, err := admission.NewDecoder(scheme.Scheme)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mutator.InjectDecoder(decoder)).To(Succeed())
+	})
+
+	It("mounts the volumes in the pod template of Eirini apps", func() {
+		statefulSet := mutate(env.EiriniAppStatefulSet("foo", twoServices), admissionv1beta1.Create)
+
+		template := statefulSet.Spec.Template
+		Expect(template.Name).To(BeEmpty())
+		Expect(template.Namespace).To(BeEmpty())
+		Expect(template.Spec.Volumes).To(Equal([]corev1.Volume{
+			{Name: "foo", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "foo"}}},
+			{Name: "bar", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "bar", ReadOnly: true}}},
+		}))
+		Expect(template.Spec.Containers[0].VolumeMounts).To(Equal([]corev1.VolumeMount{
+			{Name: "foo", MountPath: "/foo"},
+			{Name: "bar", MountPath: "/bar", ReadOnly: true},
+		}))
+		Expect(template.Annotations).To(HaveKey(persistence.InjectedAnnotation))
+		Expect(statefulSet.Annotations).ToNot(HaveKey(persistence.InjectedAnnotation))
+	})
+
+	It("reaches a fixed point when the StatefulSet is updated again", func() {
+		once := mutate(env.EiriniAppStatefulSet("foo", twoServices), admissionv1beta1.Create)
+		Expect(mutate(once, admissionv1beta1.Update)).To(Equal(once))
+	})
+
+	It("removes the volumes of the services unbound from the app", func() {
+		statefulSet := mutate(env.EiriniAppStatefulSet("foo", twoServices), admissionv1beta1.Create)
+		statefulSet.Spec.Template.Spec.Containers[0].Env[0].Value = oneService
+
+		statefulSet = mutate(statefulSet, admissionv1beta1.Update)
+		Expect(statefulSet.Spec.Template.Spec.Volumes).To(HaveLen(1))
+		Expect(statefulSet.Spec.Template.Spec.Volumes[0].Name).To(Equal("foo"))
+		Expect(statefulSet.Spec.Template.Spec.Containers[0].VolumeMounts).To(Equal([]corev1.VolumeMount{{Name: "foo", MountPath: "/foo"}}))
+	})
+
+	It("applies the mode changes of the services still bound to the app", func() {
+		statefulSet := mutate(env.EiriniAppStatefulSet("foo", oneService), admissionv1beta1.Create)
+		statefulSet.Spec.Template.Spec.Containers[0].Env[0].Value = `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo", "mode": "r"}]}]}`
+
+		statefulSet = mutate(statefulSet, admissionv1beta1.Update)
+		Expect(statefulSet.Spec.Template.Spec.Volumes).To(Equal([]corev1.Volume{
+			{Name: "foo", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "foo", ReadOnly: true}}},
+		}))
+		Expect(statefulSet.Spec.Template.Spec.Containers[0].VolumeMounts).To(Equal([]corev1.VolumeMount{{Name: "foo", MountPath: "/foo", ReadOnly: true}}))
+	})
+
+	It("applies the size changes of the scratch volumes", func() {
+		scratch := func(size string) string {
+			return `{"eirini-persi": [{"credentials": {"volume_id": "tmp", "kind": "scratch", "size_limit": "` + size + `"}, "volume_mounts": [{"container_dir": "/tmp"}]}]}`
+		}
+		statefulSet := mutate(env.EiriniAppStatefulSet("foo", scratch("1Gi")), admissionv1beta1.Create)
+		statefulSet.Spec.Template.Spec.Containers[0].Env[0].Value = scratch("5Gi")
+
+		statefulSet = mutate(statefulSet, admissionv1beta1.Update)
+		template := statefulSet.Spec.Template
+		Expect(template.Spec.Volumes).To(HaveLen(1))
+		Expect(template.Spec.Volumes[0].EmptyDir.SizeLimit.String()).To(Equal("5Gi"))
+		Expect(template.Spec.Containers[0].Resources.Requests.StorageEphemeral().String()).To(Equal("5Gi"))
+	})
+
+	It("applies the rotated credentials of SMB shares", func() {
+		mutator.Extension.Options.ServiceLabels = []string{"smb"}
+		smb := func(password string) string {
+			return `{"smb": [{"credentials": {"share": "//smb.example.com/data", "username": "alice", "password": "` + password + `"}, "volume_mounts": [{"container_dir": "/data"}]}]}`
+		}
+		statefulSet := mutate(env.EiriniAppStatefulSet("foo", smb("old")), admissionv1beta1.Create)
+		secret := statefulSet.Spec.Template.Spec.Volumes[0].CSI.NodePublishSecretRef.Name
+		statefulSet.Spec.Template.Spec.Containers[0].Env[0].Value = smb("new")
+
+		statefulSet = mutate(statefulSet, admissionv1beta1.Update)
+		Expect(statefulSet.Spec.Template.Spec.Volumes).To(HaveLen(1))
+		Expect(statefulSet.Spec.Template.Spec.Volumes[0].CSI.NodePublishSecretRef.Name).ToNot(Equal(secret))
+	})
+
+	It("leaves the StatefulSets which aren't Eirini apps untouched", func() {
+		statefulSet := env.EiriniAppStatefulSet("foo", oneService)
+		statefulSet.Labels = map[string]string{"app": "foo"}
+
+		resp, _ := handle(statefulSet, admissionv1beta1.Create)
+		Expect(resp.Allowed).To(BeTrue())
+		Expect(resp.Patches).To(BeEmpty())
+	})
+
+	It("rejects the StatefulSets with invalid volume mounts", func() {
+		resp, _ := handle(env.EiriniAppStatefulSet("foo", `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo", "mode": "x"}]}]}`), admissionv1beta1.Create)
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(resp.Result.Code).To(Equal(int32(400)))
+	})
+
+	It("provisions the claims in the namespace of the StatefulSet", func() {
+		client := &cfakes.FakeClient{}
+		client.GetCalls(func(_ context.Context, nn types.NamespacedName, _ runtime.Object) error {
+			return apierrors.NewNotFound(schema.GroupResource{Resource: "persistentvolumeclaims"}, nn.Name)
+		})
+		mutator.Extension.Client = client
+		mutate(env.EiriniAppStatefulSet("foo", `{"eirini-persi": [{"credentials": {"volume_id": "foo", "size": "1Gi"}, "volume_mounts": [{"container_dir": "/foo"}]}]}`), admissionv1beta1.Create)
+
+		Expect(client.CreateCallCount()).To(Equal(1))
+		_, object, _ := client.CreateArgsForCall(0)
+		Expect(object.(*corev1.PersistentVolumeClaim).Name).To(Equal("foo"))
+		Expect(object.(*corev1.PersistentVolumeClaim).Namespace).To(Equal("eirini"))
+	})
+})
+
+var _ = Describe("StatefulSet webhook", func() {
+	var (
+		ctx           context.Context
+		eirinixcat    eirinixcatalog.Catalog
+		eiriniManager *eirinix.DefaultExtensionManager
+		kubeManager   *cfakes.FakeManager
+		reader        *cfakes.FakeClient
+		client        *cfakes.FakeClient
+		server        *webhook.Server
+		mutator       *persistence.StatefulSetMutator
+		registered    []admissionregistrationv1beta1.MutatingWebhook
+	)
+
+	failurePolicy := admissionregistrationv1beta1.Fail
+	filter := true
+	options := eirinix.ManagerOptions{OperatorFingerprint: "eirini-persi", Namespace: "eirini", FailurePolicy: &failurePolicy, FilterEiriniApps: &filter}
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		eirinixcat = eirinixcatalog.NewCatalog()
+		registered = []admissionregistrationv1beta1.MutatingWebhook{{Name: "eirini-persi.eirini-persi.org"}}
+		reader = &cfakes.FakeClient{}
+		reader.GetCalls(func(_ context.Context, nn types.NamespacedName, obj runtime.Object) error {
+			if nn.Name != "eirini-persi-mutating-hook" {
+				return apierrors.NewNotFound(schema.GroupResource{Resource: "mutatingwebhookconfigurations"}, nn.Name)
+			}
+			config := obj.(*admissionregistrationv1beta1.MutatingWebhookConfiguration)
+			config.Name = nn.Name
+			config.Webhooks = registered
+			return nil
+		})
+		client = &cfakes.FakeClient{}
+		server = &webhook.Server{}
+
+		kubeManager = &cfakes.FakeManager{}
+		kubeManager.GetAPIReaderReturns(reader)
+		kubeManager.GetClientReturns(client)
+		kubeManager.GetSchemeReturns(scheme.Scheme)
+		kubeManager.GetWebhookServerReturns(server)
+
+		eiriniManager = &eirinix.DefaultExtensionManager{
+			KubeManager:   kubeManager,
+			Logger:        eirinixcat.SimpleManager().GetLogger(),
+			Context:       ctx,
+			Options:       options,
+			WebhookConfig: eirinix.NewWebhookConfig(nil, &eirinix.Config{WebhookServerHost: "10.0.0.1", WebhookServerPort: 4545}, nil, "eirini-persi-mutating-hook", "eirini-persi-setupcertificate", "", ""),
+		}
+		mutator = persistence.NewStatefulSetMutator(persistence.Options{}).(*persistence.StatefulSetMutator)
+	})
+
+	// updated returns the webhooks of the configuration updated by the mutator
+	updated := func() []admissionregistrationv1beta1.MutatingWebhook {
+		Expect(client.UpdateCallCount()).To(Equal(1))
+		_, obj, _ := client.UpdateArgsForCall(0)
+		return obj.(*admissionregistrationv1beta1.MutatingWebhookConfiguration).Webhooks
+	}
+
+	Describe("statefulSetWebhook", func() {
+		It("mutates the StatefulSets of Eirini apps on creation and update", func() {
+			hook := persistence.StatefulSetWebhook(options)
+			Expect(hook.Name).To(Equal("statefulsets.eirini-persi.org"))
+			Expect(hook.Path).To(Equal(persistence.StatefulSetWebhookPath))
+			Expect(hook.FailurePolicy).To(Equal(admissionregistrationv1beta1.Fail))
+			Expect(hook.GetLabelSelector().MatchLabels).To(Equal(map[string]string{eirinix.LabelSourceType: "APP"}))
+			Expect(hook.NamespaceSelector.MatchLabels).To(Equal(map[string]string{"eirini-persi-ns": "eirini"}))
+			Expect(hook.Rules).To(HaveLen(1))
+			Expect(hook.Rules[0].APIGroups).To(Equal([]string{"apps"}))
+			Expect(hook.Rules[0].Resources).To(Equal([]string{"statefulsets"}))
+			Expect(hook.Rules[0].Operations).To(ConsistOf(admissionregistrationv1beta1.Create, admissionregistrationv1beta1.Update))
+		})
+
+		It("selects every namespace and StatefulSet if the manager does", func() {
+			noFilter := false
+			hook := persistence.StatefulSetWebhook(eirinix.ManagerOptions{OperatorFingerprint: "eirini-persi", FilterEiriniApps: &noFilter})
+			Expect(hook.NamespaceSelector).To(BeNil())
+			Expect(hook.GetLabelSelector()).To(BeNil())
+		})
+	})
+
+	Describe("appendWebhooks", func() {
+		It("appends the webhooks, replacing the ones with the same name", func() {
+			webhooks := []admissionregistrationv1beta1.MutatingWebhook{{Name: "pods"}, {Name: "statefulsets"}}
+			none := admissionregistrationv1beta1.SideEffectClassNone
+
+			webhooks = persistence.AppendWebhooks(webhooks, admissionregistrationv1beta1.MutatingWebhook{Name: "statefulsets", SideEffects: &none}, admissionregistrationv1beta1.MutatingWebhook{Name: "other"})
+			Expect(webhooks).To(Equal([]admissionregistrationv1beta1.MutatingWebhook{{Name: "pods"}, {Name: "statefulsets", SideEffects: &none}, {Name: "other"}}))
+		})
+	})
+
+	Describe("Register", func() {
+		It("serves the webhook and adds it to the configuration of the manager", func() {
+			Expect(mutator.Register(eiriniManager)).To(Succeed())
+
+			_, pattern := server.WebhookMux.Handler(httptest.NewRequest("POST", persistence.StatefulSetWebhookPath, nil))
+			Expect(pattern).To(Equal(persistence.StatefulSetWebhookPath))
+
+			webhooks := updated()
+			Expect(webhooks).To(HaveLen(2))
+			Expect(webhooks[0].Name).To(Equal("eirini-persi.eirini-persi.org"))
+			Expect(webhooks[1].Name).To(Equal("statefulsets.eirini-persi.org"))
+			Expect(*webhooks[1].ClientConfig.URL).To(Equal("https://10.0.0.1:4545" + persistence.StatefulSetWebhookPath))
+			Expect(*webhooks[1].FailurePolicy).To(Equal(admissionregistrationv1beta1.Fail))
+		})
+
+		It("replaces the webhook added by an earlier start", func() {
+			registered = append(registered, admissionregistrationv1beta1.MutatingWebhook{Name: "statefulsets.eirini-persi.org"})
+
+			Expect(mutator.Register(eiriniManager)).To(Succeed())
+			webhooks := updated()
+			Expect(webhooks).To(HaveLen(2))
+			Expect(webhooks[1].ClientConfig.URL).ToNot(BeNil())
+		})
+
+		It("sets up the extension with the manager", func() {
+			Expect(mutator.Register(eiriniManager)).To(Succeed())
+			Expect(mutator.Extension.Client).To(BeIdenticalTo(client))
+			Expect(mutator.Extension.Reader).To(BeIdenticalTo(reader))
+			Expect(mutator.Extension.Options.StatefulSetMode).To(BeTrue())
+		})
+
+		It("only serves the webhook if the manager doesn't register webhooks", func() {
+			register := false
+			eiriniManager.Options.RegisterWebHook = &register
+
+			Expect(mutator.Register(eiriniManager)).To(Succeed())
+			Expect(reader.GetCallCount()).To(Equal(0))
+			Expect(client.UpdateCallCount()).To(Equal(0))
+		})
+
+		It("fails if the configuration can't be found", func() {
+			eiriniManager.WebhookConfig.ConfigName = "missing"
+
+			Expect(mutator.Register(eiriniManager)).To(MatchError(ContainSubstring("getting the webhook configuration missing")))
+		})
+
+		It("requires a started eirinix manager", func() {
+			Expect(mutator.Register(eirinixcat.SimpleManager())).To(MatchError(ContainSubstring("needs a started eirinix manager")))
+		})
+	})
+})
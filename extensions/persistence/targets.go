@@ -0,0 +1,141 @@
+package persistence
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// MountTargetAll mounts the volumes in every container and init container of the pod
+	MountTargetAll = "all"
+	// MountTargetPattern mounts the volumes in the containers and init containers matching the MountTargets of the options
+	MountTargetPattern = "pattern"
+	// MountTargetAnnotation mounts the volumes in the containers and init containers matching the MountTargetsAnnotation of the pod
+	MountTargetAnnotation = "annotation"
+
+	// MountTargetsAnnotation is the pod annotation with the comma separated name[=mode] rules of the containers
+	// the volumes are mounted in, with MountTargetAnnotation
+	MountTargetsAnnotation = "eirini-persi.cloudfoundry.org/mount-targets"
+)
+
+// mountTarget is a rule selecting the containers the volumes are mounted in, and how
+type mountTarget struct {
+	name     *regexp.Regexp
+	readOnly bool
+}
+
+// parseMountMode returns true if the target mode given as argument is read-only, which is the default
+func parseMountMode(mode string) (bool, error) {
+	switch mode {
+	case "", ModeReadOnly:
+		return true, nil
+	case ModeReadWrite:
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid mount target mode %q: must be %q or %q", mode, ModeReadOnly, ModeReadWrite)
+}
+
+// parseMountTargets returns the targets of the name[=mode] rules given as argument
+func parseMountTargets(rules []string) ([]mountTarget, error) {
+	var targets []mountTarget
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		name, mode := rule, ""
+		if i := strings.LastIndex(rule, "="); i >= 0 {
+			name, mode = rule[:i], rule[i+1:]
+		}
+		pattern, err := regexp.Compile("^(?:" + name + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid mount target %q: %w", rule, err)
+		}
+		readOnly, err := parseMountMode(mode)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, mountTarget{name: pattern, readOnly: readOnly})
+	}
+	return targets, nil
+}
+
+// validateMountTargets returns an error if the mount target policy, rules or mode of the options are invalid
+func validateMountTargets(o Options) error {
+	switch o.MountTargetPolicy {
+	case "", MountTargetAll, MountTargetPattern, MountTargetAnnotation:
+	default:
+		return fmt.Errorf("invalid mount target policy %q: must be %q, %q or %q", o.MountTargetPolicy, MountTargetAll, MountTargetPattern, MountTargetAnnotation)
+	}
+	if _, err := parseMountMode(o.MountTargetMode); err != nil {
+		return err
+	}
+	_, err := parseMountTargets(o.MountTargets)
+	return err
+}
+
+// targets returns the rules selecting the containers of the pod the volumes are mounted in, according to the options
+func (o Options) targets(pod *corev1.Pod) ([]mountTarget, error) {
+	switch o.MountTargetPolicy {
+	case MountTargetAll:
+		readOnly, err := parseMountMode(o.MountTargetMode)
+		if err != nil {
+			return nil, err
+		}
+		return []mountTarget{{name: regexp.MustCompile(".*"), readOnly: readOnly}}, nil
+	case MountTargetPattern:
+		return parseMountTargets(o.MountTargets)
+	case MountTargetAnnotation:
+		annotation, ok := pod.Annotations[MountTargetsAnnotation]
+		if !ok {
+			return nil, nil
+		}
+		targets, err := parseMountTargets(strings.Split(annotation, ","))
+		if err != nil {
+			return nil, fmt.Errorf("annotation %s: %w", MountTargetsAnnotation, err)
+		}
+		return targets, nil
+	}
+	return nil, nil
+}
+
+// mountTargets mounts the volumes of the services given as argument in the init containers, and in the containers
+// other than the apps, which are targeted by the options. The first rule matching a container decides its mode.
+func (ext *Extension) mountTargets(pod *corev1.Pod, services VcapServices, apps map[string]bool) error {
+	targets, err := ext.Options.targets(pod)
+	if err != nil || len(targets) == 0 {
+		return err
+	}
+
+	mount := func(c *corev1.Container) error {
+		for _, target := range targets {
+			if target.name.MatchString(c.Name) {
+				ext.Logger.Debugf("Appending volumes to container %s (read-only: %t)", c.Name, target.readOnly)
+				return services.appendMounts(pod, c, ext.Options, target.readOnly)
+			}
+		}
+		return nil
+	}
+
+	for i := range pod.Spec.InitContainers {
+		// The ownership init container mounts the volumes it needs
+		if pod.Spec.InitContainers[i].Name == OwnershipInitContainerName {
+			continue
+		}
+		if err := mount(&pod.Spec.InitContainers[i]); err != nil {
+			return err
+		}
+	}
+	for i := range pod.Spec.Containers {
+		if apps[pod.Spec.Containers[i].Name] {
+			continue
+		}
+		if err := mount(&pod.Spec.Containers[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package persistence_test
+
+import (
+	"context"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("Mount targets", func() {
+	var (
+		env testing.Catalog
+		ctx context.Context
+		ext *persistence.Extension
+		pod corev1.Pod
+	)
+
+	container := func(containers []corev1.Container, name string) corev1.Container {
+		for _, c := range containers {
+			if c.Name == name {
+				return c
+			}
+		}
+		Fail("no container " + name)
+		return corev1.Container{}
+	}
+
+	BeforeEach(func() {
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		ext = &persistence.Extension{Logger: eirinixcat.SimpleManager().GetLogger()}
+		pod = env.SimplePersiApp("foo")
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "log-shipper", Image: "fluentd"})
+		pod.Spec.InitContainers = []corev1.Container{{Name: "migrate", Image: "migrations"}}
+	})
+
+	It("only mounts app containers by default", func() {
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(container(pod.Spec.Containers, "log-shipper").VolumeMounts).To(BeEmpty())
+		Expect(container(pod.Spec.InitContainers, "migrate").VolumeMounts).To(BeEmpty())
+	})
+
+	It("mounts every container read-only with the all policy", func() {
+		ext.Options = persistence.Options{MountTargetPolicy: persistence.MountTargetAll}
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		Expect(pod.Spec.Volumes[0].PersistentVolumeClaim.ReadOnly).To(BeFalse())
+		Expect(pod.Spec.Containers[0].VolumeMounts[0].ReadOnly).To(BeFalse())
+		for _, c := range []corev1.Container{container(pod.Spec.Containers, "log-shipper"), container(pod.Spec.InitContainers, "migrate")} {
+			Expect(c.VolumeMounts).To(HaveLen(1))
+			Expect(c.VolumeMounts[0].Name).To(Equal("the-volume-id"))
+			Expect(c.VolumeMounts[0].MountPath).To(Equal(pod.Spec.Containers[0].VolumeMounts[0].MountPath))
+			Expect(c.VolumeMounts[0].ReadOnly).To(BeTrue())
+		}
+	})
+
+	It("mounts the containers matching the patterns with their own mode", func() {
+		ext.Options = persistence.Options{MountTargetPolicy: persistence.MountTargetPattern, MountTargets: []string{"log-.*", "migrate=rw"}}
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(container(pod.Spec.Containers, "log-shipper").VolumeMounts[0].ReadOnly).To(BeTrue())
+		Expect(container(pod.Spec.InitContainers, "migrate").VolumeMounts[0].ReadOnly).To(BeFalse())
+	})
+
+	It("keeps read-only bindings read-only", func() {
+		pod = env.DefaultEiriniAppPod("foo", `{"eirini-persi": [{"credentials": {"volume_id": "foo"}, "volume_mounts": [{"container_dir": "/foo", "mode": "r"}]}]}`)
+		pod.Spec.InitContainers = []corev1.Container{{Name: "migrate", Image: "migrations"}}
+		ext.Options = persistence.Options{MountTargetPolicy: persistence.MountTargetAll, MountTargetMode: persistence.ModeReadWrite}
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.InitContainers[0].VolumeMounts[0].ReadOnly).To(BeTrue())
+	})
+
+	It("mounts the containers matching the pod annotation", func() {
+		ext.Options = persistence.Options{MountTargetPolicy: persistence.MountTargetAnnotation}
+		pod.Annotations = map[string]string{persistence.MountTargetsAnnotation: "migrate=rw"}
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(container(pod.Spec.Containers, "log-shipper").VolumeMounts).To(BeEmpty())
+		Expect(container(pod.Spec.InitContainers, "migrate").VolumeMounts[0].ReadOnly).To(BeFalse())
+	})
+
+	It("rejects invalid annotations", func() {
+		ext.Options = persistence.Options{MountTargetPolicy: persistence.MountTargetAnnotation}
+		pod.Annotations = map[string]string{persistence.MountTargetsAnnotation: "migrate=w"}
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(MatchError(ContainSubstring(`invalid mount target mode "w"`)))
+	})
+
+	It("leaves the ownership init container alone", func() {
+		ext.Options = persistence.Options{MountTargetPolicy: persistence.MountTargetAll}
+		pod.Spec.InitContainers = []corev1.Container{{Name: persistence.OwnershipInitContainerName}}
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.InitContainers[0].VolumeMounts).To(BeEmpty())
+	})
+
+	It("validates the options", func() {
+		Expect(persistence.Options{MountTargetPolicy: "some"}.Validate()).To(MatchError(ContainSubstring(`invalid mount target policy "some"`)))
+		Expect(persistence.Options{MountTargets: []string{"log-("}}.Validate()).To(MatchError(ContainSubstring(`invalid mount target "log-("`)))
+		Expect(persistence.Options{MountTargetMode: "w"}.Validate()).To(MatchError(ContainSubstring(`invalid mount target mode "w"`)))
+	})
+})
@@ -0,0 +1,45 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// VcapServicesEnv is the environment variable declaring the services bound to the app
+const VcapServicesEnv = "VCAP_SERVICES"
+
+// vcapServicesValue returns the value of the VCAP_SERVICES environment variable given as argument, reading it
+// from the secret it references if any. It returns false if the variable references an optional secret, or key, which doesn't exist.
+func (ext *Extension) vcapServicesValue(ctx context.Context, namespace string, env corev1.EnvVar) (string, bool, error) {
+	if env.ValueFrom == nil || env.ValueFrom.SecretKeyRef == nil {
+		return env.Value, true, nil
+	}
+
+	ref := env.ValueFrom.SecretKeyRef
+	optional := ref.Optional != nil && *ref.Optional
+	reader := ext.reader()
+	if reader == nil {
+		return "", false, fmt.Errorf("reading %s from secret %s/%s: no client available", VcapServicesEnv, namespace, ref.Name)
+	}
+
+	secret := &corev1.Secret{}
+	err := reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, secret)
+	if apierrors.IsNotFound(err) && optional {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("reading %s from secret %s/%s: %w", VcapServicesEnv, namespace, ref.Name, err)
+	}
+
+	value, ok := secret.Data[ref.Key]
+	if !ok {
+		if optional {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("reading %s from secret %s/%s: key %q not found", VcapServicesEnv, namespace, ref.Name, ref.Key)
+	}
+	return string(value), true, nil
+}
@@ -0,0 +1,130 @@
+package persistence_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	persistence "code.cloudfoundry.org/eirini-persi/extensions/persistence"
+	eirinix "code.cloudfoundry.org/eirinix"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	cfakes "code.cloudfoundry.org/eirini-persi/pkg/controllers/fakes"
+	"code.cloudfoundry.org/eirini-persi/testing"
+)
+
+var _ = Describe("VCAP_SERVICES secrets", func() {
+	var (
+		eiriniManager eirinix.Manager
+		client        *cfakes.FakeClient
+		ctx           context.Context
+		env           testing.Catalog
+		ext           *persistence.Extension
+		secrets       map[string]corev1.Secret
+	)
+
+	BeforeEach(func() {
+		secrets = map[string]corev1.Secret{
+			"app-env": {Data: map[string][]byte{
+				"vcap-services": []byte(`{"eirini-persi": [{"credentials": {"volume_id": "the-volume-id"}, "volume_mounts": [{"container_dir": "/data"}]}]}`),
+			}},
+		}
+		client = &cfakes.FakeClient{}
+		client.GetCalls(func(_ context.Context, nn types.NamespacedName, obj runtime.Object) error {
+			secret, ok := secrets[nn.Name]
+			if !ok || nn.Namespace != "eirini" {
+				return apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, nn.Name)
+			}
+			secret.DeepCopyInto(obj.(*corev1.Secret))
+			return nil
+		})
+
+		ctx = testing.NewContext()
+		eirinixcat := eirinixcatalog.NewCatalog()
+		eiriniManager = eirinixcat.SimpleManager()
+		ext = &persistence.Extension{Logger: eiriniManager.GetLogger(), Client: client}
+	})
+
+	It("mounts the volumes of the services read from the secret", func() {
+		pod := env.SecretVcapServicesPod("foo", "app-env", "vcap-services")
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		Expect(pod.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("the-volume-id"))
+		Expect(pod.Spec.Containers[0].VolumeMounts[0].MountPath).To(Equal("/data"))
+	})
+
+	It("reads the secret with the reader rather than the client", func() {
+		ext.Client, ext.Reader = &cfakes.FakeClient{}, client
+		pod := env.SecretVcapServicesPod("foo", "app-env", "vcap-services")
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		Expect(client.GetCallCount()).To(Equal(1))
+		Expect(ext.Client.(*cfakes.FakeClient).GetCallCount()).To(BeZero())
+	})
+
+	It("returns an error if the secret can't be fetched", func() {
+		client.GetReturns(errors.New("connection refused"))
+		pod := env.SecretVcapServicesPod("foo", "app-env", "vcap-services")
+
+		err := ext.MountVcapVolumes(ctx, "eirini", &pod)
+		Expect(err).To(MatchError("reading VCAP_SERVICES from secret eirini/app-env: connection refused"))
+	})
+
+	It("returns an error if the secret has no such key", func() {
+		pod := env.SecretVcapServicesPod("foo", "app-env", "services")
+
+		err := ext.MountVcapVolumes(ctx, "eirini", &pod)
+		Expect(err).To(MatchError(`reading VCAP_SERVICES from secret eirini/app-env: key "services" not found`))
+	})
+
+	It("ignores missing optional secrets", func() {
+		optional := true
+		pod := env.SecretVcapServicesPod("foo", "missing", "vcap-services")
+		pod.Spec.Containers[0].Env[0].ValueFrom.SecretKeyRef.Optional = &optional
+
+		Expect(ext.MountVcapVolumes(ctx, "eirini", &pod)).To(Succeed())
+		Expect(pod.Spec.Volumes).To(BeEmpty())
+	})
+
+	It("reads the secret once per admission", func() {
+		ext.Options = persistence.Options{ClaimValidation: persistence.ClaimValidationWarn}
+		pod := env.SecretVcapServicesPod("foo", "app-env", "vcap-services")
+		request := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Namespace: "eirini"}}
+		raw, _ := json.Marshal(&pod)
+		request.Object.Raw = raw
+
+		resp := ext.Handle(ctx, eiriniManager, &pod, request)
+		Expect(resp.Allowed).To(BeTrue())
+		secretGets := 0
+		for i := 0; i < client.GetCallCount(); i++ {
+			if _, _, obj := client.GetArgsForCall(i); obj != nil {
+				if _, ok := obj.(*corev1.Secret); ok {
+					secretGets++
+				}
+			}
+		}
+		Expect(secretGets).To(Equal(1))
+	})
+
+	It("denies the admission with the fetch error", func() {
+		pod := env.SecretVcapServicesPod("foo", "missing", "vcap-services")
+		request := admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{Namespace: "eirini"}}
+
+		resp := ext.Handle(ctx, eiriniManager, &pod, request)
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(resp.Result.Code).To(Equal(int32(http.StatusBadRequest)))
+		Expect(resp.Result.Message).To(ContainSubstring("reading VCAP_SERVICES from secret eirini/missing"))
+	})
+})
@@ -5,6 +5,8 @@ go 1.14
 require (
 	code.cloudfoundry.org/eirinix v0.3.1-0.20200908072226-2c03042398ea
 	code.cloudfoundry.org/quarks-utils v0.0.0-20200807095127-abd23fde8bb1
+	github.com/evanphx/json-patch v4.5.0+incompatible
+	github.com/go-logr/logr v0.1.0
 	github.com/onsi/ginkgo v1.12.1
 	github.com/onsi/gomega v1.10.1
 	github.com/pelletier/go-toml v1.3.0 // indirect
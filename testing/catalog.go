@@ -8,6 +8,7 @@ import (
 
 	eirinix_catalog "code.cloudfoundry.org/eirinix/testing"
 	testing_utils "code.cloudfoundry.org/quarks-utils/testing"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -62,11 +63,45 @@ func (c *Catalog) PodWithVcapServices(name string, labels map[string]string, vca
 	return pod
 }
 
+// SecretVcapServicesPod generates an Eirini Application pod whose VCAP_SERVICES environment variable is read from a secret key
+func (c *Catalog) SecretVcapServicesPod(name string, secretName string, key string) corev1.Pod {
+
+	pod := c.LabeledPod(name, map[string]string{"source_type": "APP"})
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{
+		corev1.EnvVar{
+			Name: "VCAP_SERVICES",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+					Key:                  key,
+				},
+			},
+		}}
+
+	return pod
+}
+
 // DefaultEiriniAppPod generates an Eirini Application pod with VCAP_SERVICES environment variable set
 func (c *Catalog) DefaultEiriniAppPod(name string, vcapServices string) corev1.Pod {
 	return c.PodWithVcapServices(name, map[string]string{"source_type": "APP"}, vcapServices)
 }
 
+// EiriniAppStatefulSet generates the StatefulSet of an Eirini Application with VCAP_SERVICES environment variable set
+func (c *Catalog) EiriniAppStatefulSet(name string, vcapServices string) appsv1.StatefulSet {
+	labels := map[string]string{"cloudfoundry.org/source_type": "APP"}
+	pod := c.PodWithVcapServices("", labels, vcapServices)
+	return appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{ObjectMeta: pod.ObjectMeta, Spec: pod.Spec},
+		},
+	}
+}
+
 // SimplePersiApp generates an Eirini Application pod which requires persistent volume (1 volume)
 func (c *Catalog) SimplePersiApp(name string) corev1.Pod {
 	return c.DefaultEiriniAppPod(name, `{"eirini-persi": [	  {
@@ -157,3 +192,70 @@ func (c *Catalog) MultipleVolumePersiApp(name string) corev1.Pod {
 	]
 }`)
 }
+
+// MultipleMountsPersiApp generates an Eirini Application pod which mounts one persistent volume in two directories
+func (c *Catalog) MultipleMountsPersiApp(name string) corev1.Pod {
+	return c.DefaultEiriniAppPod(name, `{"eirini-persi": [	  {
+		"credentials": { "volume_id": "the-volume-id" },
+		"label": "eirini-persi",
+		"name": "my-instance",
+		"plan": "hostpath",
+		"tags": [
+			"erini",
+			"kubernetes",
+			"storage"
+		],
+		"volume_mounts": [
+			{
+				"container_dir": "/var/vcap/data/data",
+				"device_type": "shared",
+				"mode": "rw"
+			},
+			{
+				"container_dir": "/var/vcap/data/logs",
+				"device_type": "shared",
+				"mode": "rw"
+			}
+		]
+	  }
+	]
+}`)
+}
+
+// PersistentVolumeClaim generates a claim with the given access mode
+func (c *Catalog) PersistentVolumeClaim(name string, accessMode corev1.PersistentVolumeAccessMode) corev1.PersistentVolumeClaim {
+	return corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "eirini",
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{accessMode},
+		},
+		Status: corev1.PersistentVolumeClaimStatus{
+			Phase: corev1.ClaimBound,
+		},
+	}
+}
+
+// ProvisionedPersiApp generates an Eirini Application pod whose persistent volume is created on demand
+func (c *Catalog) ProvisionedPersiApp(name string) corev1.Pod {
+	pod := c.DefaultEiriniAppPod(name, `{"eirini-persi": [	  {
+		"credentials": { "volume_id": "the-volume-id", "size": "1Gi", "storage_class": "fast" },
+		"label": "eirini-persi",
+		"name": "my-instance",
+		"plan": "default",
+		"volume_mounts": [
+		  {
+			"container_dir": "/var/vcap/data/de847d34-bdcc-4c5d-92b1-cf2158a15b47",
+			"device_type": "shared",
+			"mode": "rw"
+		  }
+		]
+	  }
+	]
+}`)
+	pod.Labels["cloudfoundry.org/app_guid"] = "app-guid"
+	pod.Annotations = map[string]string{"cloudfoundry.org/space_guid": "space-guid"}
+	return pod
+}